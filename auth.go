@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fiatjaf.com/shiitake/global"
+	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotkit/app"
+	"github.com/diamondburned/gotkit/app/locale"
+)
+
+// the choices offered for each relay, in the order they're displayed
+var authPolicies = []struct {
+	label  string
+	policy global.AuthPolicy
+}{
+	{"Ask", global.AuthAsk},
+	{"Always", global.AuthAllow},
+	{"Never", global.AuthDeny},
+}
+
+// askForAuth asks the user if we can identify ourselves to a relay, blocking until they answer.
+// it is called from background goroutines.
+func askForAuth(relay string) bool {
+	answer := make(chan bool, 1)
+
+	glib.IdleAdd(func() {
+		remember := gtk.NewCheckButtonWithLabel(locale.Get("Remember my choice for this relay"))
+
+		dialog := adw.NewMessageDialog(app.GTKWindowFromContext(win.ctx),
+			locale.Get("Authenticate?"),
+			locale.Sprintf("%s wants to know who you are before it lets you see or do some things, like reading private groups. Do you want to sign in with your key?", trimProtocol(relay)))
+		dialog.SetExtraChild(remember)
+		dialog.AddResponse("deny", locale.Get("_Deny"))
+		dialog.AddResponse("allow", locale.Get("_Allow"))
+		dialog.SetResponseAppearance("allow", adw.ResponseSuggested)
+		dialog.SetDefaultResponse("allow")
+		dialog.SetCloseResponse("deny")
+		dialog.ConnectResponse(func(response string) {
+			allow := response == "allow"
+			if remember.Active() {
+				policy := global.AuthDeny
+				if allow {
+					policy = global.AuthAllow
+				}
+				global.SetAuthPolicy(relay, policy)
+			}
+			answer <- allow
+		})
+		dialog.Show()
+	})
+
+	return <-answer
+}
+
+// newAuthPolicySelector lets the user choose what happens when the relay asks us to authenticate.
+func newAuthPolicySelector(relay string) *gtk.Box {
+	labels := make([]string, len(authPolicies))
+	selected := 0
+	current := global.GetAuthPolicy(relay)
+	for i, option := range authPolicies {
+		labels[i] = option.label
+		if option.policy == current {
+			selected = i
+		}
+	}
+
+	dropdown := gtk.NewDropDownFromStrings(labels)
+	dropdown.SetSelected(uint(selected))
+	dropdown.NotifyProperty("selected", func() {
+		global.SetAuthPolicy(relay, authPolicies[dropdown.Selected()].policy)
+	})
+
+	label := gtk.NewLabel(locale.Sprintf("Authenticate with %s", trimProtocol(relay)))
+	label.SetHExpand(true)
+	label.SetXAlign(0)
+
+	box := gtk.NewBox(gtk.OrientationHorizontal, 6)
+	box.Append(label)
+	box.Append(dropdown)
+	return box
+}
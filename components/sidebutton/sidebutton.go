@@ -11,8 +11,9 @@ type Sidebutton struct {
 	*gtk.Button
 	ctx context.Context
 
-	Icon  *avatar.Avatar
-	Label *gtk.Label
+	Icon   *avatar.Avatar
+	Label  *gtk.Label
+	Marker *gtk.Image // hidden unless something calls for attention
 }
 
 func New(ctx context.Context, label string, open func()) *Sidebutton {
@@ -25,9 +26,17 @@ func New(ctx context.Context, label string, open func()) *Sidebutton {
 
 	g.Label = gtk.NewLabel(label)
 
+	g.Marker = gtk.NewImage()
+	g.Marker.AddCSSClass("ml-2")
+	g.Marker.AddCSSClass("dim-label")
+	g.Marker.SetHExpand(true)
+	g.Marker.SetHAlign(gtk.AlignEnd)
+	g.Marker.SetVisible(false)
+
 	box := gtk.NewBox(gtk.OrientationHorizontal, 0)
 	box.Append(g.Icon)
 	box.Append(g.Label)
+	box.Append(g.Marker)
 
 	g.Button = gtk.NewButton()
 	g.Button.SetHasFrame(false)
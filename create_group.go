@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+
+	"fiatjaf.com/shiitake/global"
+	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotkit/app"
+	"github.com/diamondburned/gotkit/app/locale"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// showCreateGroupDialog asks for the relay and the details of a new group, then creates it.
+func showCreateGroupDialog(ctx context.Context) {
+	relayRow := adw.NewEntryRow()
+	relayRow.SetTitle("Relay")
+	relayRow.SetText("groups.fiatjaf.com")
+
+	idRow := adw.NewEntryRow()
+	idRow.SetTitle("Identifier")
+	idRow.SetText(randomGroupID())
+
+	addressList := gtk.NewListBox()
+	addressList.SetSelectionMode(gtk.SelectionNone)
+	addressList.AddCSSClass("boxed-list")
+	addressList.AddCSSClass("mb-4")
+	addressList.Append(relayRow)
+	addressList.Append(idRow)
+
+	form, getMetadata := newGroupMetadataForm(nip29.Group{})
+
+	fields := gtk.NewBox(gtk.OrientationVertical, 0)
+	fields.Append(addressList)
+	fields.Append(form)
+
+	window := app.GTKWindowFromContext(ctx)
+	dialog := adw.NewMessageDialog(window,
+		locale.Get("New Group"),
+		locale.Get("Groups live in relays that support NIP-29, you will be the admin of this one."))
+	dialog.SetExtraChild(fields)
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("create", locale.Get("C_reate"))
+	dialog.SetResponseAppearance("create", adw.ResponseSuggested)
+	dialog.SetDefaultResponse("create")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		if response != "create" {
+			return
+		}
+
+		metadata := getMetadata()
+		metadata.Address = nip29.GroupAddress{
+			Relay: nostr.NormalizeURL(strings.TrimSpace(relayRow.Text())),
+			ID:    strings.TrimSpace(idRow.Text()),
+		}
+		if !metadata.Address.IsValid() {
+			win.ErrorToast("A relay and an identifier are needed to create a group")
+			return
+		}
+
+		win.Toast("Creating group...")
+		go func() {
+			err := global.CreateGroup(ctx, metadata)
+
+			glib.IdleAdd(func() {
+				if err != nil {
+					slog.Warn(err.Error())
+					win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+					return
+				}
+
+				win.Toast("Group created")
+				win.main.OpenGroup(metadata.Address)
+			})
+		}()
+	})
+	dialog.Show()
+}
+
+// newGroupMetadataForm displays the editable fields of a group, filled with the given values.
+// the returned function reads whatever is in the form at the moment it is called.
+func newGroupMetadataForm(initial nip29.Group) (gtk.Widgetter, func() nip29.Group) {
+	nameRow := adw.NewEntryRow()
+	nameRow.SetTitle("Name")
+	nameRow.SetText(initial.Name)
+
+	pictureRow := adw.NewEntryRow()
+	pictureRow.SetTitle("Picture URL")
+	pictureRow.SetText(initial.Picture)
+
+	aboutRow := adw.NewEntryRow()
+	aboutRow.SetTitle("About")
+	aboutRow.SetText(initial.About)
+
+	closedRow := adw.NewSwitchRow()
+	closedRow.SetTitle("Closed")
+	closedRow.SetSubtitle("Joining requires an invite code or the approval of an admin")
+	closedRow.SetActive(initial.Closed)
+
+	privateRow := adw.NewSwitchRow()
+	privateRow.SetTitle("Private")
+	privateRow.SetSubtitle("Only members can read the messages")
+	privateRow.SetActive(initial.Private)
+
+	list := gtk.NewListBox()
+	list.SetSelectionMode(gtk.SelectionNone)
+	list.AddCSSClass("boxed-list")
+	list.Append(nameRow)
+	list.Append(pictureRow)
+	list.Append(aboutRow)
+	list.Append(closedRow)
+	list.Append(privateRow)
+
+	return list, func() nip29.Group {
+		return nip29.Group{
+			Address: initial.Address,
+			Name:    strings.TrimSpace(nameRow.Text()),
+			Picture: strings.TrimSpace(pictureRow.Text()),
+			About:   strings.TrimSpace(aboutRow.Text()),
+			Closed:  closedRow.Active(),
+			Private: privateRow.Active(),
+		}
+	}
+}
+
+func randomGroupID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
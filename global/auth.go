@@ -0,0 +1,156 @@
+package global
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// AuthPolicy is what we do when a relay asks us to authenticate (NIP-42).
+type AuthPolicy string
+
+const (
+	AuthAsk   AuthPolicy = "ask"
+	AuthAllow AuthPolicy = "allow"
+	AuthDeny  AuthPolicy = "deny"
+)
+
+// AskForAuth is set by the UI and called when a relay with the AuthAsk policy wants us to authenticate.
+// it is called from a background goroutine and must block until the user answers.
+var AskForAuth func(relay string) bool
+
+var (
+	authPoliciesPath, _ = homedir.Expand("~/.local/share/shiitake/relay-auth.json")
+	authPolicies        map[string]AuthPolicy // by relay url, relays that aren't here use AuthAsk
+	authPoliciesLock    sync.Mutex
+
+	// answers given to AskForAuth, so we don't ask again every time we reconnect
+	authAnswers     = make(map[string]bool)
+	authAnswersLock sync.Mutex
+
+	// held while the user is being asked, so many groups in the same relay don't all ask together.
+	// nothing else waits for it, as the UI changes the policies while a question is open
+	authAskLock sync.Mutex
+)
+
+func loadAuthPolicies() {
+	if authPolicies != nil {
+		return
+	}
+	authPolicies = make(map[string]AuthPolicy)
+	if b, err := os.ReadFile(authPoliciesPath); err == nil {
+		if err := json.Unmarshal(b, &authPolicies); err != nil {
+			slog.Warn("failed to read relay auth settings", "err", err)
+		}
+	}
+}
+
+// GetAuthPolicy tells what we do when the given relay asks us to authenticate.
+func GetAuthPolicy(relay string) AuthPolicy {
+	authPoliciesLock.Lock()
+	defer authPoliciesLock.Unlock()
+	loadAuthPolicies()
+
+	if policy, ok := authPolicies[nostr.NormalizeURL(relay)]; ok {
+		return policy
+	}
+	return AuthAsk
+}
+
+// SetAuthPolicy changes what we do when the given relay asks us to authenticate and saves it.
+func SetAuthPolicy(relay string, policy AuthPolicy) {
+	relay = nostr.NormalizeURL(relay)
+
+	authAnswersLock.Lock()
+	delete(authAnswers, relay)
+	authAnswersLock.Unlock()
+
+	authPoliciesLock.Lock()
+	defer authPoliciesLock.Unlock()
+	loadAuthPolicies()
+
+	if policy == AuthAsk {
+		delete(authPolicies, relay)
+	} else {
+		authPolicies[relay] = policy
+	}
+
+	b, _ := json.Marshal(authPolicies)
+	os.MkdirAll(filepath.Dir(authPoliciesPath), 0755)
+	if err := os.WriteFile(authPoliciesPath, b, 0644); err != nil {
+		slog.Warn("failed to save relay auth settings", "err", err)
+	}
+}
+
+// authorize decides if we can authenticate with the given relay, asking the user if needed.
+func authorize(relay string) bool {
+	relay = nostr.NormalizeURL(relay)
+
+	// whoever was asking before us may have gotten an answer we can use
+	decided := func() (allowed bool, ok bool) {
+		switch GetAuthPolicy(relay) {
+		case AuthAllow:
+			return true, true
+		case AuthDeny:
+			return false, true
+		}
+
+		authAnswersLock.Lock()
+		defer authAnswersLock.Unlock()
+		allowed, ok = authAnswers[relay]
+		return allowed, ok
+	}
+	if allowed, ok := decided(); ok {
+		return allowed
+	}
+
+	authAskLock.Lock()
+	defer authAskLock.Unlock()
+
+	if allowed, ok := decided(); ok {
+		return allowed
+	}
+	if AskForAuth == nil {
+		return false
+	}
+	allowed := AskForAuth(relay)
+
+	authAnswersLock.Lock()
+	authAnswers[relay] = allowed
+	authAnswersLock.Unlock()
+	return allowed
+}
+
+// handleAuthRequest is given to the pool, so relays that are used through it can authenticate us.
+func handleAuthRequest(ctx context.Context, ie nostr.RelayEvent) error {
+	if !authorize(ie.Relay.URL) {
+		return fmt.Errorf("authentication with %s is not allowed", ie.Relay.URL)
+	}
+	return K.SignEvent(ctx, ie.Event)
+}
+
+// authIfRequired authenticates with the relay if the reason it gave for refusing something
+// is that it requires authentication. it returns true when the refused thing can be tried again.
+func authIfRequired(ctx context.Context, relay *nostr.Relay, reason string) bool {
+	if !strings.Contains(reason, "auth-required:") {
+		return false
+	}
+	if !authorize(relay.URL) {
+		slog.Info("not authenticating", "relay", relay.URL)
+		return false
+	}
+
+	if err := relay.Auth(ctx, func(evt *nostr.Event) error { return K.SignEvent(ctx, evt) }); err != nil {
+		slog.Warn("failed to authenticate", "relay", relay.URL, "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package global
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withTestAuth makes authorize use a clean state and ask, which counts the questions.
+func withTestAuth(t *testing.T, ask func(relay string) bool) *atomic.Int32 {
+	previousPath, previousAsk := authPoliciesPath, AskForAuth
+	t.Cleanup(func() {
+		authPoliciesPath, AskForAuth = previousPath, previousAsk
+		authPolicies = nil
+		authAnswers = make(map[string]bool)
+	})
+
+	authPoliciesPath = filepath.Join(t.TempDir(), "relay-auth.json")
+	authPolicies = nil
+	authAnswers = make(map[string]bool)
+
+	asked := &atomic.Int32{}
+	AskForAuth = func(relay string) bool {
+		asked.Add(1)
+		return ask(relay)
+	}
+	return asked
+}
+
+// authorizeWithin fails the test if authorize doesn't return in time, which means it's stuck.
+func authorizeWithin(t *testing.T, relay string) bool {
+	result := make(chan bool, 1)
+	go func() { result <- authorize(relay) }()
+	select {
+	case allowed := <-result:
+		return allowed
+	case <-time.After(5 * time.Second):
+		t.Fatalf("authorize(%q) is stuck", relay)
+		return false
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	const relay = "wss://groups.example.com"
+
+	for _, tc := range []struct {
+		name   string
+		policy AuthPolicy
+		answer bool
+		// the user ticks "Remember my choice", which changes the policy while being asked
+		remember bool
+		want     bool
+		asked    int32
+	}{
+		{"allowed by the policy", AuthAllow, false, false, true, 0},
+		{"denied by the policy", AuthDeny, true, false, false, 0},
+		{"allowed by the user", AuthAsk, true, false, true, 1},
+		{"denied by the user", AuthAsk, false, false, false, 1},
+		{"allowed and remembered", AuthAsk, true, true, true, 1},
+		{"denied and remembered", AuthAsk, false, true, false, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			asked := withTestAuth(t, func(relay string) bool {
+				if tc.remember {
+					policy := AuthDeny
+					if tc.answer {
+						policy = AuthAllow
+					}
+					SetAuthPolicy(relay, policy)
+				}
+				return tc.answer
+			})
+			SetAuthPolicy(relay, tc.policy)
+
+			// the second time the answer we already have is used
+			for range 2 {
+				if allowed := authorizeWithin(t, relay); allowed != tc.want {
+					t.Errorf("authorize = %v, want %v", allowed, tc.want)
+				}
+			}
+			if asked.Load() != tc.asked {
+				t.Errorf("asked %d times, want %d", asked.Load(), tc.asked)
+			}
+
+			if tc.remember {
+				if policy := GetAuthPolicy(relay); policy == AuthAsk {
+					t.Errorf("the choice wasn't remembered")
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeAsksOnce(t *testing.T) {
+	const relay = "wss://groups.example.com"
+
+	asking := make(chan struct{}, 5)
+	answer := make(chan bool)
+	asked := withTestAuth(t, func(string) bool {
+		asking <- struct{}{}
+		return <-answer
+	})
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !authorize(relay) {
+				t.Error("authorize = false, want true")
+			}
+		}()
+	}
+
+	// the policy can be changed in the UI while the question is open
+	<-asking
+	changed := make(chan struct{})
+	go func() {
+		SetAuthPolicy("wss://other.example.com", AuthDeny)
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetAuthPolicy is stuck while the user is being asked")
+	}
+
+	answer <- true
+	wg.Wait()
+
+	if asked.Load() != 1 {
+		t.Errorf("asked %d times, want 1", asked.Load())
+	}
+}
@@ -0,0 +1,52 @@
+package global
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// messageCursor remembers up to where we've received the messages of a group, so that when we subscribe
+// again we only ask for the ones that came after. the messages that come before EOSE are held until then,
+// and they're kept if the subscription is closed before it, as we won't ask for them again.
+type messageCursor struct {
+	newest       nostr.Timestamp
+	seenAtNewest []string // ids of the messages we've seen created at newest
+	held         []*nostr.Event
+}
+
+// isNew takes note of a message and tells if it isn't one we've already received. messages older than
+// the newest aren't checked, as a new subscription doesn't ask for those.
+func (c *messageCursor) isNew(evt *nostr.Event) bool {
+	if evt.CreatedAt == c.newest && slices.Contains(c.seenAtNewest, evt.ID) {
+		return false
+	}
+	if evt.CreatedAt > c.newest {
+		c.newest = evt.CreatedAt
+		c.seenAtNewest = c.seenAtNewest[:0]
+	}
+	if evt.CreatedAt == c.newest {
+		c.seenAtNewest = append(c.seenAtNewest, evt.ID)
+	}
+	return true
+}
+
+// since is where a new subscription should start, nil if we haven't received anything yet.
+func (c *messageCursor) since() *nostr.Timestamp {
+	if c.newest == 0 {
+		return nil
+	}
+	since := c.newest
+	return &since
+}
+
+// hold keeps a message that came before EOSE.
+func (c *messageCursor) hold(evt *nostr.Event) { c.held = append(c.held, evt) }
+
+// take returns the messages that were held, oldest first, and forgets them.
+func (c *messageCursor) take() []*nostr.Event {
+	held := c.held
+	c.held = nil
+	slices.SortStableFunc(held, func(a, b *nostr.Event) int { return int(a.CreatedAt - b.CreatedAt) })
+	return held
+}
@@ -0,0 +1,106 @@
+package global
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testMessage(createdAt nostr.Timestamp, n int) *nostr.Event {
+	return &nostr.Event{ID: fmt.Sprintf("%d-%d", createdAt, n), CreatedAt: createdAt, Kind: 9}
+}
+
+// a subscription as keepSubscribed sees it: some messages and then either EOSE or the subscription closing
+type testSubscription struct {
+	since    nostr.Timestamp // what we expect to ask for, 0 for everything
+	received []*nostr.Event
+	eose     bool
+}
+
+func TestMessageCursor(t *testing.T) {
+	a, b, c := testMessage(10, 1), testMessage(20, 1), testMessage(30, 1)
+	c2, d := testMessage(30, 2), testMessage(40, 1)
+
+	for _, tc := range []struct {
+		name          string
+		subscriptions []testSubscription
+		delivered     []*nostr.Event // everything taken at each EOSE, in order
+	}{
+		{
+			"one subscription, newest first",
+			[]testSubscription{{0, []*nostr.Event{c, b, a}, true}},
+			[]*nostr.Event{a, b, c},
+		},
+		{
+			"closed before EOSE",
+			[]testSubscription{
+				{0, []*nostr.Event{c, b}, false},
+				{30, []*nostr.Event{c, d}, true},
+			},
+			[]*nostr.Event{b, c, d},
+		},
+		{
+			"closed twice before EOSE",
+			[]testSubscription{
+				{0, []*nostr.Event{b}, false},
+				{20, []*nostr.Event{b, c}, false},
+				{30, []*nostr.Event{c, c2}, true},
+			},
+			[]*nostr.Event{b, c, c2},
+		},
+		{
+			"resubscribed after EOSE",
+			[]testSubscription{
+				{0, []*nostr.Event{b, a}, true},
+				{20, []*nostr.Event{b, c, c2}, true},
+			},
+			[]*nostr.Event{a, b, c, c2},
+		},
+		{
+			"nothing new",
+			[]testSubscription{
+				{0, []*nostr.Event{c, b}, true},
+				{30, []*nostr.Event{c}, true},
+			},
+			[]*nostr.Event{b, c},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cursor messageCursor
+			var delivered []*nostr.Event
+
+			for i, sub := range tc.subscriptions {
+				var since nostr.Timestamp
+				if s := cursor.since(); s != nil {
+					since = *s
+				}
+				if since != sub.since {
+					t.Errorf("subscription %d is since %d, want %d", i, since, sub.since)
+				}
+
+				for _, evt := range sub.received {
+					if cursor.isNew(evt) {
+						cursor.hold(evt)
+					}
+				}
+				if sub.eose {
+					delivered = append(delivered, cursor.take()...)
+				}
+			}
+
+			if !slices.Equal(delivered, tc.delivered) {
+				t.Errorf("delivered %v, want %v", eventIDs(delivered), eventIDs(tc.delivered))
+			}
+		})
+	}
+}
+
+func eventIDs(events []*nostr.Event) []string {
+	result := make([]string, len(events))
+	for i, evt := range events {
+		result[i] = evt.ID
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package global
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// Draft is what we were writing in a group and haven't sent yet.
+type Draft struct {
+	Text    string `json:"text"`
+	ReplyTo string `json:"reply_to,omitempty"` // id of the message we're replying to
+}
+
+func (d Draft) IsEmpty() bool { return d.Text == "" && d.ReplyTo == "" }
+
+// drafts are kept on disk so they survive the app being closed (or crashing)
+var (
+	draftsPath, _ = homedir.Expand("~/.local/share/shiitake/drafts.json")
+	drafts        map[string]Draft // by group address
+	draftsLock    sync.Mutex
+)
+
+func loadDrafts() {
+	if drafts != nil {
+		return
+	}
+	drafts = make(map[string]Draft)
+	if b, err := os.ReadFile(draftsPath); err == nil {
+		if err := json.Unmarshal(b, &drafts); err != nil {
+			slog.Warn("failed to read drafts", "err", err)
+		}
+	}
+}
+
+// GetDraft returns what was being written in a group, it is empty if there is nothing.
+func GetDraft(gad nip29.GroupAddress) Draft {
+	draftsLock.Lock()
+	defer draftsLock.Unlock()
+	loadDrafts()
+	return drafts[gad.String()]
+}
+
+// SetDraft saves what is being written in a group, an empty draft removes it.
+func SetDraft(gad nip29.GroupAddress, draft Draft) {
+	draftsLock.Lock()
+	defer draftsLock.Unlock()
+	loadDrafts()
+
+	if current, ok := drafts[gad.String()]; ok && current == draft || !ok && draft.IsEmpty() {
+		return
+	}
+	if draft.IsEmpty() {
+		delete(drafts, gad.String())
+	} else {
+		drafts[gad.String()] = draft
+	}
+
+	b, _ := json.Marshal(drafts)
+	os.MkdirAll(filepath.Dir(draftsPath), 0755)
+	if err := os.WriteFile(draftsPath, b, 0644); err != nil {
+		slog.Warn("failed to save drafts", "err", err)
+	}
+}
@@ -2,25 +2,84 @@ package global
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
+	"maps"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bep/debounce"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/nbd-wtf/go-nostr/nip29"
 )
 
 var groups = make(map[string]*Group)
 
+// when a group relay drops us we wait this long before trying again, doubling on every failure
+const (
+	minReconnectDelay = time.Second * 2
+	maxReconnectDelay = time.Minute * 5
+)
+
 type Group struct {
 	nip29.Group
-	NewMessage     chan *nostr.Event
+	NewMessage     Queue[*nostr.Event]
 	StoredMessages chan []*nostr.Event
+	Delivered      Queue[Delivery] // messages from the outbox that we've tried to send after reconnecting
+
+	// held while Members is replaced, and while the roles and the times of the lists they come from
+	// change. readers never see the map being changed as we always make a new one
+	membership sync.Mutex
+	admins     map[string]struct{} // everybody in the latest kind 39001 event
+
+	// set when we can't trust the metadata (name, admins, members and roles) we have for this group
+	metadataWarning struct {
+		sync.Mutex
+		text string
+	}
+
+	connected atomic.Bool
+	close     context.CancelFunc // stops following the group
+	flushing  sync.Mutex         // held while we send what is in the outbox
+
+	// events we've seen, for making and checking "previous" tags
+	timeline struct {
+		sync.Mutex
+		seen      map[string]nostr.Timestamp // created_at of everything we've seen, by the first 8 chars of the id
+		latest    []seenEvent                // the latest events we've seen, oldest first
+		forgotten int                        // how many events we've seen that are older than the ones in latest
+	}
+
+	// kind 7 reactions and kind 5 deletions of these
+	reactions struct {
+		sync.Mutex
+		byTarget  map[string][]*nostr.Event // reactions to each message, by message id
+		targets   map[string]string         // the message each reaction points to, by reaction id
+		listeners []func(id string)
+	}
+
+	// moderation events (kinds 9000-9009) and join/leave requests
+	moderation struct {
+		sync.Mutex
+		history   []*nostr.Event             // everything we've seen, in the order it came
+		seen      map[string]struct{}        // ids of the events in history
+		requests  map[string]*nostr.Event    // latest join request of each user, by pubkey
+		handled   map[string]nostr.Timestamp // when each user was last added, removed or has left, by pubkey
+		deleted   map[string]struct{}        // ids of the messages deleted by kind 9005 events
+		listeners []func(evt *nostr.Event)
+
+		groupDeleted bool // by a kind 9008 event
+		onDeleted    []func()
+	}
 
 	update struct {
 		listeners []func()
@@ -44,90 +103,568 @@ func GetGroup(ctx context.Context, gad nip29.GroupAddress) *Group {
 			Name:    gad.ID,
 			Members: make(map[string][]*nip29.Role, 5),
 		},
-		NewMessage:     make(chan *nostr.Event),
 		StoredMessages: make(chan []*nostr.Event),
 	}
+	group.update.debouncer = debounce.New(700 * time.Millisecond)
 	groups[gad.String()] = group
 
-	relay, err := System.Pool.EnsureRelay(group.Address.Relay)
-	if err != nil {
-		slog.Warn("connect error", "relay", group.Address.Relay, "err", err)
-		return group
+	ctx, group.close = context.WithCancel(ctx)
+	go func() {
+		group.keepSubscribed(ctx)
+
+		// when we leave a group or when we were just browsing it and leave, we close the subscription
+		// and remove it from our list of cached groups
+		getGroupMutex.Lock()
+		if groups[gad.String()] == group {
+			delete(groups, gad.String())
+		}
+		getGroupMutex.Unlock()
+	}()
+
+	return group
+}
+
+// keepSubscribed subscribes to the group relay and keeps resubscribing whenever the subscription
+// is closed, until ctx is canceled. messages we already have (either from the local store or from
+// a previous subscription) are not requested again: only the ones that came after them are fetched
+// with a "since" and dispatched through NewMessage in chronological order.
+func (g *Group) keepSubscribed(ctx context.Context) {
+	// used to resume from where we stopped without dispatching anything twice, or losing what we didn't dispatch
+	var cursor messageCursor
+
+	// reactions and moderation events are not deduplicated here, we just don't ask again for the ones older than these
+	var newestReaction nostr.Timestamp
+	var newestModeration nostr.Timestamp
+
+	// stored messages are given to whoever is listening all at once (newest first), and only once
+	deliveredStored := false
+	deliverStored := func(stored []*nostr.Event) {
+		deliveredStored = true
+		go func() {
+			select {
+			case g.StoredMessages <- stored:
+			case <-ctx.Done():
+			}
+		}()
 	}
 
-	sub, err := relay.Subscribe(ctx, nostr.Filters{
-		{
-			Kinds: []int{39000, 39001, 39002},
-			Tags: nostr.TagMap{
-				"d": []string{group.Address.ID},
-			},
-			Limit: 3,
+	// whatever we have in the local store is displayed immediately, so groups can be opened while offline
+	cached, _ := System.StoreRelay.QuerySync(ctx, nostr.Filter{
+		Kinds: []int{9, 10},
+		Tags: nostr.TagMap{
+			"h": []string{g.Address.ID},
 		},
-		{
+		Limit: 500,
+	})
+	if len(cached) > 0 {
+		slices.SortFunc(cached, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+		for _, evt := range cached {
+			cursor.isNew(evt)
+			g.see(evt)
+		}
+		deliverStored(cached)
+	}
+
+	delay := minReconnectDelay
+
+	// if the relay still refuses us right after we've authenticated we don't insist immediately
+	justAuthenticated := false
+
+	// group metadata is only valid if signed by the relay, and we only know its key after reading its NIP-11.
+	// until then none of it is taken, and once we know the key we subscribe again to get it
+	var relayPubKey string
+	relayPubKeyKnown := false
+	relayPubKeys := make(chan string, 1)
+	go g.fetchRelayPubKey(ctx, relayPubKeys)
+	learnRelayPubKey := func(pubkey string) {
+		relayPubKeyKnown = true
+		relayPubKey = pubkey
+		if pubkey == "" {
+			g.setMetadataWarning("The relay doesn't publish its public key, the group admins and members can't be verified.")
+		} else {
+			g.setMetadataWarning("")
+		}
+	}
+
+	for {
+		// set when the relay closes the subscription for a reason that we've fixed already
+		retryNow := false
+
+		// set when we learn the relay key, so we get the metadata we couldn't take before.
+		// that waits for EOSE, so the messages held until then are delivered first
+		resubscribe := false
+
+		messagesFilter := nostr.Filter{
 			Kinds: []int{9, 10},
 			Tags: nostr.TagMap{
-				"h": []string{group.Address.ID},
+				"h": []string{g.Address.ID},
+			},
+		}
+		if since := cursor.since(); since == nil {
+			log.Printf("opening subscription to %s", g.Address)
+			messagesFilter.Limit = 500
+		} else {
+			log.Printf("subscribing to %s since %d", g.Address, *since)
+			messagesFilter.Since = since
+		}
+
+		reactionsFilter := nostr.Filter{
+			Kinds: []int{nostr.KindReaction, nostr.KindDeletion},
+			Tags: nostr.TagMap{
+				"h": []string{g.Address.ID},
+			},
+		}
+		if newestReaction == 0 {
+			reactionsFilter.Limit = 500
+		} else {
+			since := newestReaction
+			reactionsFilter.Since = &since
+		}
+
+		moderationFilter := nostr.Filter{
+			Kinds: append(slices.Clone(nip29.ModerationEventKinds),
+				nostr.KindSimpleGroupJoinRequest, nostr.KindSimpleGroupLeaveRequest),
+			Tags: nostr.TagMap{
+				"h": []string{g.Address.ID},
+			},
+		}
+		if newestModeration == 0 {
+			moderationFilter.Limit = 500
+		} else {
+			since := newestModeration
+			moderationFilter.Since = &since
+		}
+
+		if relay, err := System.Pool.EnsureRelay(g.Address.Relay); err != nil {
+			slog.Warn("connect error", "relay", g.Address.Relay, "err", err)
+			g.triggerUpdate()
+		} else if sub, err := relay.Subscribe(ctx, nostr.Filters{
+			{
+				Kinds: []int{39000, 39001, 39002, 39003},
+				Tags: nostr.TagMap{
+					"d": []string{g.Address.ID},
+				},
+				Limit: 4,
 			},
-			Limit: 500,
+			messagesFilter,
+			reactionsFilter,
+			moderationFilter,
+		}); err != nil {
+			slog.Warn("subscription error", "relay", g.Address.Relay, "err", err)
+			g.triggerUpdate()
+		} else {
+			g.setConnected(true)
+
+			// messages that come before EOSE are held by the cursor
+			eosed := false
+
+		events:
+			for {
+				select {
+				case evt, ok := <-sub.Events:
+					if !ok {
+						select {
+						case reason := <-sub.ClosedReason:
+							slog.Warn("subscription closed", "group", g.Address, "reason", reason)
+							retryNow = !justAuthenticated && authIfRequired(ctx, relay, reason)
+						default:
+							slog.Warn("subscription closed", "group", g.Address)
+						}
+						break events
+					}
+
+					g.see(evt)
+
+					if nip29.MetadataEventKinds.Includes(evt.Kind) {
+						if !relayPubKeyKnown || relayPubKey == "" && evt.Kind != 39000 {
+							// we can't tell who signed it, and only the name and description are harmless if made up
+							continue
+						}
+						if relayPubKey != "" && evt.PubKey != relayPubKey {
+							// anyone else could be making up the names, admins and members of the group
+							slog.Warn("ignoring group metadata not signed by the relay", "group", g.Address, "kind", evt.Kind, "pubkey", evt.PubKey)
+							g.setMetadataWarning("The relay sent group details signed by someone else, they were ignored.")
+							continue
+						}
+						if relayPubKey != "" {
+							// what the relay signed replaces whatever we were told by someone else
+							g.setMetadataWarning("")
+						}
+					}
+
+					switch evt.Kind {
+					case 39000:
+						if evt.CreatedAt < g.LastMetadataUpdate {
+							continue
+						}
+						// these are only set when their tags are there, so a group that was opened again would keep them
+						g.Private = false
+						g.Closed = false
+						g.Group.MergeInMetadataEvent(evt)
+						g.triggerUpdate()
+					case 39001:
+						g.mergeInAdminsEvent(evt)
+						g.triggerUpdate()
+					case 39002:
+						g.mergeInMembersEvent(evt)
+						g.triggerUpdate()
+					case 39003:
+						g.mergeInRolesEvent(evt)
+						g.triggerUpdate()
+					case 9, 10:
+						if !cursor.isNew(evt) {
+							continue
+						}
+						System.StoreRelay.Publish(ctx, *evt)
+						if eosed {
+							g.NewMessage.push(evt)
+						} else {
+							cursor.hold(evt)
+						}
+					case nostr.KindReaction, nostr.KindDeletion:
+						if evt.CreatedAt > newestReaction {
+							newestReaction = evt.CreatedAt
+						}
+						g.handleReaction(evt)
+					default:
+						if !nip29.ModerationEventKinds.Includes(evt.Kind) &&
+							evt.Kind != nostr.KindSimpleGroupJoinRequest && evt.Kind != nostr.KindSimpleGroupLeaveRequest {
+							continue
+						}
+						if evt.CreatedAt > newestModeration {
+							newestModeration = evt.CreatedAt
+						}
+						if evt.Kind == nostr.KindSimpleGroupDeleteEvent {
+							g.forgetDeleted(ctx, evt)
+						}
+						if g.applyMembershipChange(evt) {
+							g.triggerUpdate()
+						}
+						g.handleModeration(evt)
+						if evt.Kind == nostr.KindSimpleGroupDeleteGroup {
+							g.markDeleted(ctx)
+
+							// there is nothing else to follow
+							sub.Unsub()
+							g.setConnected(false)
+							return
+						}
+					}
+				case reason := <-sub.ClosedReason:
+					slog.Warn("subscription closed", "group", g.Address, "reason", reason)
+					retryNow = !justAuthenticated && authIfRequired(ctx, relay, reason)
+					break events
+				case pubkey := <-relayPubKeys:
+					learnRelayPubKey(pubkey)
+					resubscribe = true
+					if eosed {
+						break events
+					}
+				case <-sub.EndOfStoredEvents:
+					eosed = true
+					delay = minReconnectDelay
+
+					stored := cursor.take()
+					if !deliveredStored {
+						slices.Reverse(stored)
+						deliverStored(stored)
+					} else {
+						// the gap we've missed is delivered as if these were new messages, oldest first
+						for _, evt := range stored {
+							g.NewMessage.push(evt)
+						}
+					}
+
+					// now that we're connected again whatever is waiting in the outbox can be sent
+					go g.flushOutbox(ctx)
+
+					if resubscribe {
+						break events
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			sub.Unsub()
+			g.setConnected(false)
+		}
+
+		justAuthenticated = retryNow
+		if retryNow || resubscribe {
+			continue
+		}
+
+		select {
+		case <-time.After(delay):
+			delay = min(delay*2, maxReconnectDelay)
+		case pubkey := <-relayPubKeys:
+			// we'll get the metadata when we reconnect
+			learnRelayPubKey(pubkey)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchRelayPubKey keeps trying to read the NIP-11 of the group relay until it gets it, then sends its key
+// (which is empty if the relay doesn't publish one).
+func (g *Group) fetchRelayPubKey(ctx context.Context, result chan<- string) {
+	delay := minReconnectDelay
+	for {
+		pubkey, err := RelayPubKey(ctx, g.Address.Relay)
+		if err == nil {
+			result <- pubkey
+			return
+		}
+
+		slog.Warn("can't verify group metadata", "group", g.Address, "err", err)
+		g.setMetadataWarning("Couldn't get the relay's public key, the group details can't be verified yet.")
+
+		select {
+		case <-time.After(delay):
+			delay = min(delay*2, maxReconnectDelay)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forgetDeleted removes from the local store the messages a kind 9005 event has deleted,
+// so they don't show up again the next time the group is opened.
+func (g *Group) forgetDeleted(ctx context.Context, deletion *nostr.Event) {
+	ids := make([]string, 0, 1)
+	for _, tag := range deletion.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			ids = append(ids, tag[1])
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	// only messages of this group, so a deletion can't reach anything else we have stored
+	stored, _ := System.StoreRelay.QuerySync(ctx, nostr.Filter{
+		IDs:   ids,
+		Kinds: []int{9, 10},
+		Tags: nostr.TagMap{
+			"h": []string{g.Address.ID},
 		},
 	})
-	if err != nil {
-		slog.Warn("subscription error", "relay", group.Address.Relay, "err", err)
-		return group
+	for _, evt := range stored {
+		if err := System.Store.DeleteEvent(ctx, evt); err != nil {
+			slog.Warn("failed to delete stored message", "id", evt.ID, "err", err)
+		}
 	}
+}
 
-	group.update.debouncer = debounce.New(700 * time.Millisecond)
+// forget removes a group that doesn't exist anymore from our list and from the pending join requests.
+func (g *Group) forget(ctx context.Context) {
+	setJoinPending(g.Address, 0)
+	SetDraft(g.Address, Draft{})
+	if err := removeFromLastList(ctx, g.Address); err != nil {
+		slog.Warn("failed to remove deleted group from list", "group", g.Address, "err", err)
+	}
+}
 
-	storedMessagesChan := make(chan *nostr.Event)
-	chanTarget := storedMessagesChan
+// IsAdmin tells if the relay lists the given pubkey among the admins of the group. roles given
+// to members by other means (like the ones we apply from kind 9000 events) don't count.
+func (g *Group) IsAdmin(pubkey string) bool {
+	g.membership.Lock()
+	defer g.membership.Unlock()
+	_, isAdmin := g.admins[pubkey]
+	return isAdmin
+}
 
-	go func() {
-		log.Printf("opening subscription to %s", group.Address)
-		for {
-			select {
-			case evt, ok := <-sub.Events:
-				if !ok {
-					slog.Warn("subscription closed", "group", group.Address)
-					return
-				}
+// mergeInRolesEvent takes the role definitions from a kind 39003 event.
+func (g *Group) mergeInRolesEvent(evt *nostr.Event) {
+	g.updateMembers(func(members map[string][]*nip29.Role) bool {
+		if evt.CreatedAt < g.LastRolesUpdate {
+			return false
+		}
+		g.LastRolesUpdate = evt.CreatedAt
+
+		roles := make([]*nip29.Role, 0, len(evt.Tags))
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "role" || tag[1] == "" {
+				continue
+			}
+			role := &nip29.Role{Name: tag[1]}
+			if len(tag) >= 3 {
+				role.Description = tag[2]
+			}
+			roles = append(roles, role)
+		}
+		g.Roles = roles
+
+		// members may have been given roles before we knew about them, so they must point to the new definitions
+		for pubkey, roles := range members {
+			updated := make([]*nip29.Role, len(roles))
+			for i, role := range roles {
+				updated[i] = g.GetRoleByName(role.Name)
+			}
+			members[pubkey] = updated
+		}
+		return true
+	})
+}
+
+// updateMembers changes a copy of Members and then puts it in place, unless change returns false.
+func (g *Group) updateMembers(change func(members map[string][]*nip29.Role) bool) {
+	g.membership.Lock()
+	defer g.membership.Unlock()
+
+	members := maps.Clone(g.Members)
+	if change(members) {
+		g.Members = members
+	}
+}
+
+// mergeInMembersEvent takes the members from a kind 39002 event, which is the whole list: whoever
+// isn't there anymore has left or was removed.
+func (g *Group) mergeInMembersEvent(evt *nostr.Event) {
+	g.updateMembers(func(members map[string][]*nip29.Role) bool {
+		if evt.CreatedAt <= g.LastMembersUpdate {
+			return false
+		}
+		g.LastMembersUpdate = evt.CreatedAt
 
-				switch evt.Kind {
-				case 39000:
-					group.Group.MergeInMetadataEvent(evt)
-					group.triggerUpdate()
-				case 39001:
-					group.Group.MergeInAdminsEvent(evt)
-					group.triggerUpdate()
-				case 39002:
-					group.Group.MergeInMembersEvent(evt)
-					group.triggerUpdate()
-				case 9, 10:
-					chanTarget <- evt
+		listed := make(map[string]struct{}, len(evt.Tags))
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValid32ByteHex(tag[1]) {
+				listed[tag[1]] = struct{}{}
+				if _, ok := members[tag[1]]; !ok {
+					members[tag[1]] = nil
 				}
-			case <-sub.EndOfStoredEvents:
-				chanTarget = group.NewMessage
-				close(storedMessagesChan)
+			}
+		}
 
-			case <-ctx.Done():
-				// when we leave a group or when we were just browsing it and leave, we close the subscription
-				// and remove it from our list of cached groups
-				getGroupMutex.Lock()
-				delete(groups, gad.String())
-				getGroupMutex.Unlock()
-				return
+		// admins are still members even if the relay doesn't list them here
+		maps.DeleteFunc(members, func(pubkey string, _ []*nip29.Role) bool {
+			_, isListed := listed[pubkey]
+			_, isAdmin := g.admins[pubkey]
+			return !isListed && !isAdmin
+		})
+		return true
+	})
+}
+
+// mergeInAdminsEvent takes the roles from a kind 39001 event, which are all the roles anyone has:
+// members that aren't there anymore have lost theirs.
+func (g *Group) mergeInAdminsEvent(evt *nostr.Event) {
+	g.updateMembers(func(members map[string][]*nip29.Role) bool {
+		if evt.CreatedAt <= g.LastAdminsUpdate {
+			return false
+		}
+		g.LastAdminsUpdate = evt.CreatedAt
+
+		admins := make(map[string]struct{}, len(evt.Tags))
+		for pubkey := range members {
+			members[pubkey] = nil
+		}
+		for _, tag := range evt.Tags {
+			if len(tag) < 3 || tag[0] != "p" || !nostr.IsValid32ByteHex(tag[1]) {
+				continue
 			}
+			admins[tag[1]] = struct{}{}
+			roles := make([]*nip29.Role, 0, len(tag)-2)
+			for _, name := range tag[2:] {
+				roles = append(roles, g.GetRoleByName(name))
+			}
+			members[tag[1]] = roles
 		}
-	}()
+		g.admins = admins
+		return true
+	})
+}
 
-	go func() {
-		storedMessages := make([]*nostr.Event, 0, 500)
-		for evt := range storedMessagesChan {
-			storedMessages = append(storedMessages, evt)
+// applyMembershipChange applies a kind 9000 or 9001 event to the members we have, so we don't have to
+// wait for the relay to send a new list. it tells if anything has changed.
+func (g *Group) applyMembershipChange(evt *nostr.Event) bool {
+	if evt.Kind != nostr.KindSimpleGroupPutUser && evt.Kind != nostr.KindSimpleGroupRemoveUser {
+		return false
+	}
+
+	changed := false
+	g.updateMembers(func(members map[string][]*nip29.Role) bool {
+		if evt.CreatedAt < g.LastMembersUpdate {
+			// the list we have already includes this
+			return false
 		}
-		group.StoredMessages <- storedMessages
-	}()
 
-	return group
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "p" || !nostr.IsValid32ByteHex(tag[1]) {
+				continue
+			}
+			changed = true
+
+			if evt.Kind == nostr.KindSimpleGroupRemoveUser {
+				delete(members, tag[1])
+				if evt.CreatedAt >= g.LastAdminsUpdate {
+					// otherwise they would still be an admin, and a member too, until the relay lists the admins again
+					delete(g.admins, tag[1])
+				}
+				continue
+			}
+			roles := members[tag[1]]
+			if len(tag) > 2 && evt.CreatedAt >= g.LastAdminsUpdate {
+				roles = make([]*nip29.Role, 0, len(tag)-2)
+				for _, name := range tag[2:] {
+					roles = append(roles, g.GetRoleByName(name))
+				}
+			}
+			members[tag[1]] = roles
+		}
+		return changed
+	})
+	return changed
+}
+
+// RoleNames returns the names of all the roles we know about in this group, both the ones
+// the relay has announced and the ones we've seen assigned to members.
+func (g *Group) RoleNames() []string {
+	names := make([]string, 0, len(g.Roles)+2)
+	for _, role := range g.Roles {
+		if !slices.Contains(names, role.Name) {
+			names = append(names, role.Name)
+		}
+	}
+	for _, roles := range g.Members {
+		for _, role := range roles {
+			if !slices.Contains(names, role.Name) {
+				names = append(names, role.Name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// IsConnected tells if we currently have a live subscription to the group relay.
+func (g *Group) IsConnected() bool { return g.connected.Load() }
+
+// MetadataWarning tells why the metadata we have for this group can't be trusted, empty if it can.
+func (g *Group) MetadataWarning() string {
+	g.metadataWarning.Lock()
+	defer g.metadataWarning.Unlock()
+	return g.metadataWarning.text
+}
+
+func (g *Group) setMetadataWarning(text string) {
+	g.metadataWarning.Lock()
+	changed := g.metadataWarning.text != text
+	g.metadataWarning.text = text
+	g.metadataWarning.Unlock()
+
+	if changed {
+		g.triggerUpdate()
+	}
+}
+
+func (g *Group) setConnected(connected bool) {
+	if g.connected.Swap(connected) != connected {
+		g.triggerUpdate()
+	}
 }
 
 func (g *Group) OnUpdated(fn func()) { g.update.listeners = append(g.update.listeners, fn) }
@@ -140,7 +677,12 @@ func (g *Group) triggerUpdate() {
 	})
 }
 
-func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
+// ErrJoinPending is returned by JoinGroup when the relay hasn't added us right away, which means
+// our request is waiting for an admin to approve it. we keep waiting for that in the background.
+var ErrJoinPending = errors.New("join request is waiting for approval")
+
+// JoinGroup asks to join a group, optionally with an invite code and a message to the admins.
+func JoinGroup(ctx context.Context, gad nip29.GroupAddress, code string, reason string) error {
 	since := nostr.Now() - 1
 
 	// ask to join group
@@ -148,14 +690,19 @@ func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
 		Kind:      nostr.KindSimpleGroupJoinRequest,
 		CreatedAt: nostr.Now(),
 		Tags:      nostr.Tags{nostr.Tag{"h", gad.ID}},
+		Content:   reason,
 	}
-	if err := K.SignEvent(ctx, &joinRequest); err != nil {
-		return err
+	if code != "" {
+		joinRequest.Tags = append(joinRequest.Tags, nostr.Tag{"code", code})
 	}
 	groupRelay, err := System.Pool.EnsureRelay(gad.Relay)
 	if err != nil {
 		return err
 	}
+	difficulty, err := prepareEvent(ctx, gad.Relay, &joinRequest)
+	if err != nil {
+		return err
+	}
 
 	// wait for an automatic response -- or nothing
 	sctx, cancel := context.WithTimeout(ctx, time.Second*5)
@@ -163,9 +710,7 @@ func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
 
 	sub, err := groupRelay.Subscribe(sctx, nostr.Filters{
 		{
-			// doesn't exist
-			// Kinds: []int{nostr.KindSimpleGroupAddUser},
-			Kinds: []int{9000},
+			Kinds: []int{nostr.KindSimpleGroupPutUser},
 			Tags: nostr.TagMap{
 				"h": []string{gad.ID},
 				"p": []string{joinRequest.PubKey},
@@ -177,7 +722,7 @@ func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
 		return err
 	}
 
-	if err := groupRelay.Publish(ctx, joinRequest); err != nil && !strings.Contains(err.Error(), "already a member") {
+	if err := publishPrepared(ctx, groupRelay, &joinRequest, difficulty); err != nil && !strings.Contains(err.Error(), "already a member") {
 		return err
 	}
 
@@ -185,11 +730,81 @@ func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
 	case <-sub.Events:
 		// if an event comes that means we are successful and will move on to the next step
 	case <-sctx.Done():
-		// otherwise we were denied
-		return fmt.Errorf("not authorized to join group")
+		// otherwise the request was accepted by the relay but someone has to approve it
+		setJoinPending(gad, since)
+		startWatchingPendingJoin(gad, since)
+		return ErrJoinPending
+	}
+
+	return addToLastList(ctx, gad)
+}
+
+// CreateGroup creates a group at a relay that supports NIP-29, sets its metadata and adds it to our list.
+// the group is added to the list even if the metadata fails to be set, as it exists anyway.
+func CreateGroup(ctx context.Context, metadata nip29.Group) error {
+	gad := metadata.Address
+
+	info, err := nip11.Fetch(ctx, gad.Relay)
+	if err != nil {
+		return fmt.Errorf("failed to get information from '%s': %w", gad.Relay, err)
+	}
+	if !slices.ContainsFunc(info.SupportedNIPs, func(n any) bool { return fmt.Sprint(n) == "29" }) {
+		return fmt.Errorf("%s doesn't support groups", gad.Relay)
 	}
 
-	// add group to user list of groups
+	create := nostr.Event{
+		Kind:      nostr.KindSimpleGroupCreateGroup,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{nostr.Tag{"h", gad.ID}},
+	}
+	if err := publishToGroup(ctx, gad, &create); err != nil {
+		return err
+	}
+
+	edit := editMetadataEvent(metadata)
+	metadataErr := publishToGroup(ctx, gad, &edit)
+
+	if err := addToLastList(ctx, gad); err != nil {
+		return fmt.Errorf("group created, but failed to add it to your list: %w", err)
+	}
+	if metadataErr != nil {
+		return fmt.Errorf("group created, but failed to set its details: %w", metadataErr)
+	}
+
+	return nil
+}
+
+// editMetadataEvent makes the kind 9002 event that sets all the metadata fields of a group.
+func editMetadataEvent(metadata nip29.Group) nostr.Event {
+	evt := nostr.Event{
+		Kind:      nostr.KindSimpleGroupEditMetadata,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			nostr.Tag{"h", metadata.Address.ID},
+			nostr.Tag{"name", metadata.Name},
+			nostr.Tag{"about", metadata.About},
+			nostr.Tag{"picture", metadata.Picture},
+		},
+	}
+
+	if metadata.Private {
+		evt.Tags = append(evt.Tags, nostr.Tag{"private"})
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"public"})
+	}
+	if metadata.Closed {
+		evt.Tags = append(evt.Tags, nostr.Tag{"closed"})
+	} else {
+		evt.Tags = append(evt.Tags, nostr.Tag{"open"})
+	}
+
+	return evt
+}
+
+// addToLastList adds a group to our kind 10009 list and publishes it.
+func addToLastList(ctx context.Context, gad nip29.GroupAddress) error {
+	setJoinPending(gad, 0)
+
 	newTag := []string{"group", gad.ID, gad.Relay}
 	var found *nostr.Tag
 	if me.lastList == nil {
@@ -210,12 +825,88 @@ func JoinGroup(ctx context.Context, gad nip29.GroupAddress) error {
 }
 
 func LeaveGroup(ctx context.Context, gad nip29.GroupAddress) error {
+	// tell the relay we're leaving and remove the group from our list even if that fails,
+	// errors are only reported at the end so the user knows which of these things happened
+	setJoinPending(gad, 0)
+	relayErr := leaveGroupRelay(ctx, gad)
+	listErr := removeFromLastList(ctx, gad)
+
+	switch {
+	case relayErr != nil && listErr != nil:
+		return fmt.Errorf("failed to leave group: %w; also failed to remove it from your list: %w", relayErr, listErr)
+	case relayErr != nil:
+		return fmt.Errorf("removed group from your list, but you may still be a member at %s: %w", gad.Relay, relayErr)
+	case listErr != nil:
+		return fmt.Errorf("left the group, but failed to remove it from your list: %w", listErr)
+	}
+
+	return nil
+}
+
+// leaveGroupRelay sends a leave request and waits for the relay to remove us.
+func leaveGroupRelay(ctx context.Context, gad nip29.GroupAddress) error {
+	since := nostr.Now() - 1
+
+	leaveRequest := nostr.Event{
+		Kind:      nostr.KindSimpleGroupLeaveRequest,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{nostr.Tag{"h", gad.ID}},
+	}
+	groupRelay, err := System.Pool.EnsureRelay(gad.Relay)
+	if err != nil {
+		return err
+	}
+	difficulty, err := prepareEvent(ctx, gad.Relay, &leaveRequest)
+	if err != nil {
+		return err
+	}
+
+	// wait for the relay to remove us
+	sctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	sub, err := groupRelay.Subscribe(sctx, nostr.Filters{
+		{
+			Kinds: []int{nostr.KindSimpleGroupRemoveUser},
+			Tags: nostr.TagMap{
+				"h": []string{gad.ID},
+				"p": []string{leaveRequest.PubKey},
+			},
+			Since: &since,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := publishPrepared(ctx, groupRelay, &leaveRequest, difficulty); err != nil {
+		if strings.Contains(err.Error(), "not a member") {
+			return nil
+		}
+		return err
+	}
+
+	select {
+	case _, ok := <-sub.Events:
+		if !ok {
+			// the subscription was closed, by the relay or because we've waited too long
+			return fmt.Errorf("relay didn't confirm we were removed")
+		}
+		// the relay has removed us
+		return nil
+	case <-sctx.Done():
+		return fmt.Errorf("relay didn't confirm we were removed")
+	}
+}
+
+func removeFromLastList(ctx context.Context, gad nip29.GroupAddress) error {
 	if me.lastList == nil {
 		return nil
 	}
 	before := len(me.lastList.Tags)
 	me.lastList.Tags = slices.DeleteFunc(me.lastList.Tags, func(t nostr.Tag) bool {
-		return t[0] == "group" &&
+		return len(t) >= 3 &&
+			t[0] == "group" &&
 			t[1] == gad.ID &&
 			t[2] == gad.Relay
 	})
@@ -229,31 +920,291 @@ func LeaveGroup(ctx context.Context, gad nip29.GroupAddress) error {
 	return nil
 }
 
-func (g Group) SendChatMessage(ctx context.Context, text string, replyTo string) error {
+// LoadOlderMessages fetches up to limit chat messages created at or before until,
+// sorted from the newest to the oldest.
+func (g *Group) LoadOlderMessages(ctx context.Context, until nostr.Timestamp, limit int) ([]*nostr.Event, error) {
+	filter := nostr.Filter{
+		Kinds: []int{9, 10},
+		Tags: nostr.TagMap{
+			"h": []string{g.Address.ID},
+		},
+		Until: &until,
+		Limit: limit,
+	}
+
+	relay, err := System.Pool.EnsureRelay(g.Address.Relay)
+	if err != nil {
+		// when we can't reach the relay we can still show what we have stored locally
+		if events, _ := System.StoreRelay.QuerySync(ctx, filter); len(events) > 0 {
+			slices.SortFunc(events, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+			return events, nil
+		}
+		return nil, fmt.Errorf("connection to '%s' failed: %w", g.Address.Relay, err)
+	}
+
+	events, err := relay.QuerySync(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load older messages from %s: %w", g.Address, err)
+	}
+	for _, evt := range events {
+		System.StoreRelay.Publish(ctx, *evt)
+		g.see(evt)
+	}
+
+	slices.SortFunc(events, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+	return events, nil
+}
+
+// GetMessage returns the chat message with the given id, from the local store or from the group relay.
+func (g *Group) GetMessage(ctx context.Context, id string) (*nostr.Event, error) {
+	filter := nostr.Filter{
+		IDs: []string{id},
+		Tags: nostr.TagMap{
+			"h": []string{g.Address.ID},
+		},
+	}
+
+	if events, _ := System.StoreRelay.QuerySync(ctx, filter); len(events) > 0 {
+		return events[0], nil
+	}
+
+	relay, err := System.Pool.EnsureRelay(g.Address.Relay)
+	if err != nil {
+		return nil, fmt.Errorf("connection to '%s' failed: %w", g.Address.Relay, err)
+	}
+
+	events, err := relay.QuerySync(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message %s from %s: %w", id, g.Address, err)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("message %s not found in %s", id, g.Address)
+	}
+
+	System.StoreRelay.Publish(ctx, *events[0])
+	g.see(events[0])
+	return events[0], nil
+}
+
+// PutUser adds a user to the group, or changes the roles they have.
+func (g *Group) PutUser(ctx context.Context, pubkey string, roles ...string) error {
 	evt := nostr.Event{
-		Kind: 9,
+		Kind: nostr.KindSimpleGroupPutUser,
 		Tags: nostr.Tags{
 			nostr.Tag{"h", g.Address.ID},
+			append(nostr.Tag{"p", pubkey}, roles...),
 		},
 		CreatedAt: nostr.Now(),
-		Content:   text,
 	}
-	if replyTo != "" {
-		evt.Tags = append(evt.Tags, nostr.Tag{"e", replyTo})
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return err
 	}
 
-	if err := K.SignEvent(ctx, &evt); err != nil {
-		return fmt.Errorf("failed to sign: %w", err)
+	// the relay will also send this back to us, but we can apply it now
+	g.handleModeration(&evt)
+	if g.applyMembershipChange(&evt) {
+		g.triggerUpdate()
 	}
+	return nil
+}
 
-	relay, err := System.Pool.EnsureRelay(g.Address.Relay)
+// RemoveUser removes a user from the group, it is also how we turn down a join request.
+func (g *Group) RemoveUser(ctx context.Context, pubkey string, reason string) error {
+	evt := nostr.Event{
+		Kind: nostr.KindSimpleGroupRemoveUser,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+			nostr.Tag{"p", pubkey},
+		},
+		CreatedAt: nostr.Now(),
+		Content:   reason,
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return err
+	}
+
+	g.handleModeration(&evt)
+	if g.applyMembershipChange(&evt) {
+		g.triggerUpdate()
+	}
+	return nil
+}
+
+// EditMetadata replaces the name, picture, about and status of the group. the relay
+// will then issue a new kind 39000 event, which is when we'll actually see the changes.
+func (g *Group) EditMetadata(ctx context.Context, metadata nip29.Group) error {
+	metadata.Address = g.Address
+	evt := editMetadataEvent(metadata)
+	return g.publish(ctx, &evt)
+}
+
+// DeleteMessage asks the relay to delete a message from the group, which is allowed for admins
+// and, depending on the relay, for the author of the message.
+func (g *Group) DeleteMessage(ctx context.Context, id string) error {
+	evt := nostr.Event{
+		Kind: nostr.KindSimpleGroupDeleteEvent,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+			nostr.Tag{"e", id},
+		},
+		CreatedAt: nostr.Now(),
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return err
+	}
+
+	g.forgetDeleted(ctx, &evt)
+	g.handleModeration(&evt)
+	return nil
+}
+
+// Delete asks the relay to delete the group entirely, then stops following it.
+func (g *Group) Delete(ctx context.Context) error {
+	evt := nostr.Event{
+		Kind:      nostr.KindSimpleGroupDeleteGroup,
+		Tags:      nostr.Tags{nostr.Tag{"h", g.Address.ID}},
+		CreatedAt: nostr.Now(),
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return err
+	}
+
+	g.handleModeration(&evt)
+	g.markDeleted(ctx)
+	g.close()
+	return nil
+}
+
+// CreateInvite asks the relay to accept a new invite code for this group, which is returned.
+func (g *Group) CreateInvite(ctx context.Context) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+
+	evt := nostr.Event{
+		Kind: nostr.KindSimpleGroupCreateInvite,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+			nostr.Tag{"code", code},
+		},
+		CreatedAt: nostr.Now(),
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// React publishes a reaction to the given message.
+func (g *Group) React(ctx context.Context, target *nostr.Event, emoji string) (*nostr.Event, error) {
+	evt := nostr.Event{
+		Kind: nostr.KindReaction,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+			nostr.Tag{"e", target.ID},
+			nostr.Tag{"p", target.PubKey},
+			nostr.Tag{"k", strconv.Itoa(target.Kind)},
+		},
+		CreatedAt: nostr.Now(),
+		Content:   emoji,
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return nil, err
+	}
+
+	// don't wait for the relay to send it back to us
+	g.handleReaction(&evt)
+	return &evt, nil
+}
+
+// Unreact asks the relay to delete one of our reactions.
+func (g *Group) Unreact(ctx context.Context, reaction *nostr.Event) (*nostr.Event, error) {
+	evt := nostr.Event{
+		Kind: nostr.KindDeletion,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+			nostr.Tag{"e", reaction.ID},
+			nostr.Tag{"k", strconv.Itoa(nostr.KindReaction)},
+		},
+		CreatedAt: nostr.Now(),
+	}
+
+	if err := g.publish(ctx, &evt); err != nil {
+		return nil, err
+	}
+
+	g.handleReaction(&evt)
+	return &evt, nil
+}
+
+// publish sends an event to the group, referencing some of the latest events we've seen in it.
+func (g *Group) publish(ctx context.Context, evt *nostr.Event) error {
+	if previous := g.previousTag(); previous != nil {
+		evt.Tags = append(evt.Tags, previous)
+	}
+	if err := publishToGroup(ctx, g.Address, evt); err != nil {
+		return err
+	}
+	g.see(evt)
+	return nil
+}
+
+func publishToGroup(ctx context.Context, gad nip29.GroupAddress, evt *nostr.Event) error {
+	relay, err := System.Pool.EnsureRelay(gad.Relay)
 	if err != nil {
-		return fmt.Errorf("connection to '%s' failed: %w", g.Address.Relay, err)
+		return fmt.Errorf("connection to '%s' failed: %w", gad.Relay, err)
 	}
 
-	if err := relay.Publish(ctx, evt); err != nil {
-		return fmt.Errorf("publish to %s failed: %w", g.Address, err)
+	difficulty, err := prepareEvent(ctx, gad.Relay, evt)
+	if err != nil {
+		return err
+	}
+	if err := publishPrepared(ctx, relay, evt, difficulty); err != nil {
+		return fmt.Errorf("publish to %s failed: %w", gad, err)
 	}
 
 	return nil
 }
+
+// prepareEvent does the proof-of-work the relay requires, if any, then signs the event.
+// it returns the difficulty that was used.
+func prepareEvent(ctx context.Context, url string, evt *nostr.Event) (int, error) {
+	difficulty := powDifficulty(ctx, url)
+	if difficulty > 0 {
+		if err := doWork(ctx, evt, difficulty); err != nil {
+			return 0, err
+		}
+	}
+	if err := K.SignEvent(ctx, evt); err != nil {
+		return 0, fmt.Errorf("failed to sign: %w", err)
+	}
+	return difficulty, nil
+}
+
+// publishPrepared publishes an event made by prepareEvent, trying again if the relay turns it
+// down because it wants us to authenticate or to do more work than we did.
+func publishPrepared(ctx context.Context, relay *nostr.Relay, evt *nostr.Event, difficulty int) error {
+	err := relay.Publish(ctx, *evt)
+	if err != nil && authIfRequired(ctx, relay, err.Error()) {
+		err = relay.Publish(ctx, *evt)
+	}
+	if err != nil {
+		// the relay may want more work than it announced, or not announce it at all
+		if required := learnPoWDifficulty(relay.URL, err.Error()); required > difficulty {
+			if err := doWork(ctx, evt, required); err != nil {
+				return err
+			}
+			if err := K.SignEvent(ctx, evt); err != nil {
+				return fmt.Errorf("failed to sign: %w", err)
+			}
+			err = relay.Publish(ctx, *evt)
+		}
+	}
+	return err
+}
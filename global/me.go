@@ -77,6 +77,12 @@ func GetMe(ctx context.Context) *Me {
 
 	me.listUpdate.debouncer = debounce.New(700 * time.Millisecond)
 
+	for gadstr, since := range loadPendingJoins() {
+		if gad, err := nip29.ParseGroupAddress(gadstr); err == nil {
+			startWatchingPendingJoin(gad, since)
+		}
+	}
+
 	go func() {
 		for ie := range System.Pool.SubscribeMany(bg, System.MetadataRelays.URLs, nostr.Filter{
 			Kinds:   []int{0},
@@ -0,0 +1,177 @@
+package global
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// applyTestEvent does with a membership event what keepSubscribed, AddUser or RemoveUser would.
+func applyTestEvent(g *Group, evt *nostr.Event) {
+	switch evt.Kind {
+	case 39001:
+		g.mergeInAdminsEvent(evt)
+	case 39002:
+		g.mergeInMembersEvent(evt)
+	case 39003:
+		g.mergeInRolesEvent(evt)
+	default:
+		g.applyMembershipChange(evt)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	a, b, c := strings.Repeat("a", 64), strings.Repeat("b", 64), strings.Repeat("c", 64)
+	event := func(kind int, createdAt nostr.Timestamp, tags ...nostr.Tag) *nostr.Event {
+		return &nostr.Event{Kind: kind, CreatedAt: createdAt, Tags: tags}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		events  []*nostr.Event
+		members map[string][]string // the names of the roles of each member
+		admins  []string
+	}{
+		{
+			"a newer list replaces the members",
+			[]*nostr.Event{event(39002, 1, nostr.Tag{"p", a}, nostr.Tag{"p", b}), event(39002, 2, nostr.Tag{"p", b}, nostr.Tag{"p", c})},
+			map[string][]string{b: nil, c: nil},
+			nil,
+		},
+		{
+			"an older list is ignored",
+			[]*nostr.Event{event(39002, 2, nostr.Tag{"p", a}), event(39002, 1, nostr.Tag{"p", b})},
+			map[string][]string{a: nil},
+			nil,
+		},
+		{
+			"a list from the same time is ignored",
+			[]*nostr.Event{event(39002, 1, nostr.Tag{"p", a}), event(39002, 1, nostr.Tag{"p", b})},
+			map[string][]string{a: nil},
+			nil,
+		},
+		{
+			"invalid pubkeys are ignored",
+			[]*nostr.Event{event(39002, 1, nostr.Tag{"p", a}, nostr.Tag{"p", "abc"}, nostr.Tag{"p"})},
+			map[string][]string{a: nil},
+			nil,
+		},
+		{
+			"admins are members even if they aren't listed",
+			[]*nostr.Event{event(39001, 1, nostr.Tag{"p", a, "admin"}), event(39002, 2, nostr.Tag{"p", b})},
+			map[string][]string{a: {"admin"}, b: nil},
+			[]string{a},
+		},
+		{
+			"a newer admins list takes roles away",
+			[]*nostr.Event{
+				event(39001, 1, nostr.Tag{"p", a, "admin"}, nostr.Tag{"p", b, "moderator"}),
+				event(39002, 1, nostr.Tag{"p", a}, nostr.Tag{"p", b}),
+				event(39001, 2, nostr.Tag{"p", a, "admin"}),
+			},
+			map[string][]string{a: {"admin"}, b: nil},
+			[]string{a},
+		},
+		{
+			"added after the list",
+			[]*nostr.Event{event(39002, 1, nostr.Tag{"p", a}), event(9000, 2, nostr.Tag{"p", b})},
+			map[string][]string{a: nil, b: nil},
+			nil,
+		},
+		{
+			"added before the list, which doesn't have them anymore",
+			[]*nostr.Event{event(39002, 2, nostr.Tag{"p", a}), event(9000, 1, nostr.Tag{"p", b})},
+			map[string][]string{a: nil},
+			nil,
+		},
+		{
+			"removed after the list",
+			[]*nostr.Event{event(39002, 1, nostr.Tag{"p", a}, nostr.Tag{"p", b}), event(9001, 2, nostr.Tag{"p", b})},
+			map[string][]string{a: nil},
+			nil,
+		},
+		{
+			"a removed admin doesn't come back with the next members list",
+			[]*nostr.Event{
+				event(39001, 1, nostr.Tag{"p", a, "admin"}),
+				event(9001, 2, nostr.Tag{"p", a}),
+				event(39002, 3, nostr.Tag{"p", b}),
+			},
+			map[string][]string{b: nil},
+			nil,
+		},
+		{
+			"roles given after the admins list",
+			[]*nostr.Event{event(39001, 1, nostr.Tag{"p", a, "admin"}), event(9000, 2, nostr.Tag{"p", b, "moderator"})},
+			map[string][]string{a: {"admin"}, b: {"moderator"}},
+			[]string{a},
+		},
+		{
+			"roles given before the admins list, which doesn't have them anymore",
+			[]*nostr.Event{event(39001, 2, nostr.Tag{"p", a, "admin"}), event(9000, 1, nostr.Tag{"p", b, "moderator"})},
+			map[string][]string{a: {"admin"}, b: nil},
+			[]string{a},
+		},
+		{
+			"roles are kept when added again without them",
+			[]*nostr.Event{event(9000, 1, nostr.Tag{"p", b, "moderator"}), event(9000, 2, nostr.Tag{"p", b})},
+			map[string][]string{b: {"moderator"}},
+			nil,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &Group{Group: nip29.Group{Members: make(map[string][]*nip29.Role)}}
+			for _, evt := range tc.events {
+				applyTestEvent(g, evt)
+			}
+
+			members := make(map[string][]string, len(g.Members))
+			for pubkey, roles := range g.Members {
+				var names []string
+				for _, role := range roles {
+					names = append(names, role.Name)
+				}
+				members[pubkey] = names
+			}
+			if !maps.EqualFunc(members, tc.members, slices.Equal) {
+				t.Errorf("members are %v, want %v", members, tc.members)
+			}
+
+			for _, pubkey := range []string{a, b, c} {
+				if want := slices.Contains(tc.admins, pubkey); g.IsAdmin(pubkey) != want {
+					t.Errorf("IsAdmin(%s…) = %v, want %v", pubkey[0:4], !want, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoleDefinitions(t *testing.T) {
+	a := strings.Repeat("a", 64)
+
+	g := &Group{Group: nip29.Group{Members: make(map[string][]*nip29.Role)}}
+	applyTestEvent(g, &nostr.Event{Kind: 39001, CreatedAt: 1, Tags: nostr.Tags{{"p", a, "moderator"}}})
+	before := g.Members
+
+	// the roles the member was given before we knew about them now point to the definitions
+	applyTestEvent(g, &nostr.Event{Kind: 39003, CreatedAt: 1, Tags: nostr.Tags{{"role", "moderator", "keeps things tidy"}}})
+	if roles := g.Members[a]; len(roles) != 1 || roles[0].Description != "keeps things tidy" {
+		t.Errorf("roles are %v, want the moderator definition", roles)
+	}
+	if len(g.Roles) != 1 {
+		t.Errorf("roles are %v, want only moderator", g.Roles)
+	}
+	if before[a][0].Description != "" {
+		t.Errorf("the members we had before were changed instead of replaced")
+	}
+
+	// an older definition is ignored
+	applyTestEvent(g, &nostr.Event{Kind: 39003, CreatedAt: 0, Tags: nostr.Tags{{"role", "moderator", "old"}}})
+	if g.GetRoleByName("moderator").Description != "keeps things tidy" {
+		t.Errorf("an older definition replaced the newer one")
+	}
+}
@@ -0,0 +1,131 @@
+package global
+
+import (
+	"context"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// handleModeration takes a moderation event (kinds 9000-9009) or a join/leave request, keeps it in
+// the group history and updates the join requests, then tells whoever is displaying the group.
+func (g *Group) handleModeration(evt *nostr.Event) {
+	g.moderation.Lock()
+	if g.moderation.seen == nil {
+		g.moderation.seen = make(map[string]struct{}, 100)
+		g.moderation.requests = make(map[string]*nostr.Event)
+		g.moderation.handled = make(map[string]nostr.Timestamp)
+		g.moderation.deleted = make(map[string]struct{})
+	}
+	if _, seen := g.moderation.seen[evt.ID]; seen {
+		g.moderation.Unlock()
+		return
+	}
+	g.moderation.seen[evt.ID] = struct{}{}
+	g.moderation.history = append(g.moderation.history, evt)
+
+	switch evt.Kind {
+	case nostr.KindSimpleGroupDeleteEvent:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				g.moderation.deleted[tag[1]] = struct{}{}
+			}
+		}
+	case nostr.KindSimpleGroupJoinRequest:
+		if existing, ok := g.moderation.requests[evt.PubKey]; !ok || existing.CreatedAt < evt.CreatedAt {
+			g.moderation.requests[evt.PubKey] = evt
+		}
+	case nostr.KindSimpleGroupLeaveRequest:
+		g.markRequestHandled(evt.PubKey, evt.CreatedAt)
+	case nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				g.markRequestHandled(tag[1], evt.CreatedAt)
+			}
+		}
+	}
+
+	listeners := slices.Clone(g.moderation.listeners)
+	g.moderation.Unlock()
+
+	for _, fn := range listeners {
+		fn(evt)
+	}
+}
+
+// markRequestHandled must be called with the moderation lock held.
+func (g *Group) markRequestHandled(pubkey string, at nostr.Timestamp) {
+	if g.moderation.handled[pubkey] < at {
+		g.moderation.handled[pubkey] = at
+	}
+}
+
+// OnModeration calls fn with every moderation event and join/leave request we've seen in the group
+// so far, then with each new one. fn is called from the relay subscription, so it must not block.
+func (g *Group) OnModeration(fn func(evt *nostr.Event)) {
+	g.moderation.Lock()
+	defer g.moderation.Unlock()
+
+	for _, evt := range g.moderation.history {
+		fn(evt)
+	}
+	g.moderation.listeners = append(g.moderation.listeners, fn)
+}
+
+// JoinRequests returns the requests to join the group that nobody has answered yet, oldest first.
+func (g *Group) JoinRequests() []*nostr.Event {
+	g.moderation.Lock()
+	defer g.moderation.Unlock()
+
+	pending := make([]*nostr.Event, 0, len(g.moderation.requests))
+	for pubkey, request := range g.moderation.requests {
+		if request.CreatedAt <= g.moderation.handled[pubkey] {
+			continue
+		}
+		if _, isMember := g.Members[pubkey]; isMember {
+			continue
+		}
+		pending = append(pending, request)
+	}
+	slices.SortFunc(pending, func(a, b *nostr.Event) int { return int(a.CreatedAt - b.CreatedAt) })
+	return pending
+}
+
+// IsDeleted tells if a message was deleted by a moderation event, so it shouldn't be displayed
+// even if we still have it from before.
+func (g *Group) IsDeleted(id string) bool {
+	g.moderation.Lock()
+	defer g.moderation.Unlock()
+	_, deleted := g.moderation.deleted[id]
+	return deleted
+}
+
+// markDeleted forgets a group that doesn't exist anymore and tells everybody who is displaying it.
+func (g *Group) markDeleted(ctx context.Context) {
+	g.moderation.Lock()
+	if g.moderation.groupDeleted {
+		g.moderation.Unlock()
+		return
+	}
+	g.moderation.groupDeleted = true
+	listeners := slices.Clone(g.moderation.onDeleted)
+	g.moderation.Unlock()
+
+	g.forget(ctx)
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
+// OnDeleted calls fn once the group is deleted, or right away if it already was.
+// fn is called from the relay subscription, so it must not block.
+func (g *Group) OnDeleted(fn func()) {
+	g.moderation.Lock()
+	if !g.moderation.groupDeleted {
+		g.moderation.onDeleted = append(g.moderation.onDeleted, fn)
+		g.moderation.Unlock()
+		return
+	}
+	g.moderation.Unlock()
+	fn()
+}
@@ -0,0 +1,175 @@
+package global
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// ErrQueued is returned when a message can't be sent because the relay is unreachable or didn't answer.
+// it stays in the outbox and is sent as soon as we're connected to the relay again.
+var ErrQueued = errors.New("relay unreachable, the message will be sent when it's back")
+
+// Delivery tells what happened to a message from the outbox that we've tried to send again.
+type Delivery struct {
+	ID    string       // the id the message had when it was queued
+	Event *nostr.Event // the message as it was published, the id changes if the relay wanted more proof-of-work
+	Err   error
+}
+
+// messages that couldn't be sent because the relay was unreachable are kept on disk so
+// they're not lost if the app is closed before we get to send them
+var (
+	outboxPath, _ = homedir.Expand("~/.local/share/shiitake/outbox.json")
+	outbox        map[string][]*nostr.Event // by group address, oldest first
+	outboxLock    sync.Mutex
+)
+
+func loadOutbox() {
+	if outbox != nil {
+		return
+	}
+	outbox = make(map[string][]*nostr.Event)
+	if b, err := os.ReadFile(outboxPath); err == nil {
+		if err := json.Unmarshal(b, &outbox); err != nil {
+			slog.Warn("failed to read outbox", "err", err)
+		}
+	}
+}
+
+func saveOutbox() {
+	b, _ := json.Marshal(outbox)
+	os.MkdirAll(filepath.Dir(outboxPath), 0755)
+	if err := os.WriteFile(outboxPath, b, 0644); err != nil {
+		slog.Warn("failed to save outbox", "err", err)
+	}
+}
+
+func queueMessage(gad nip29.GroupAddress, evt *nostr.Event) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+	loadOutbox()
+
+	queued := outbox[gad.String()]
+	if slices.ContainsFunc(queued, func(q *nostr.Event) bool { return q.ID == evt.ID }) {
+		return
+	}
+	outbox[gad.String()] = append(queued, evt)
+	saveOutbox()
+}
+
+func unqueueMessage(gad nip29.GroupAddress, id string) {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+	loadOutbox()
+
+	queued := outbox[gad.String()]
+	if !slices.ContainsFunc(queued, func(q *nostr.Event) bool { return q.ID == id }) {
+		return
+	}
+	queued = slices.DeleteFunc(queued, func(q *nostr.Event) bool { return q.ID == id })
+	if len(queued) == 0 {
+		delete(outbox, gad.String())
+	} else {
+		outbox[gad.String()] = queued
+	}
+	saveOutbox()
+}
+
+// Outbox returns the messages that are waiting for the group relay to be reachable, oldest first.
+func (g *Group) Outbox() []*nostr.Event {
+	outboxLock.Lock()
+	defer outboxLock.Unlock()
+	loadOutbox()
+	return slices.Clone(outbox[g.Address.String()])
+}
+
+// Discard gives up on sending a message that is in the outbox or that has failed.
+func (g *Group) Discard(id string) {
+	unqueueMessage(g.Address, id)
+}
+
+// PrepareChatMessage makes a signed chat message, with the proof-of-work the relay requires, ready to be delivered.
+func (g *Group) PrepareChatMessage(ctx context.Context, text string, replyTo string) (*nostr.Event, error) {
+	evt := nostr.Event{
+		Kind: 9,
+		Tags: nostr.Tags{
+			nostr.Tag{"h", g.Address.ID},
+		},
+		CreatedAt: nostr.Now(),
+		Content:   text,
+	}
+	if replyTo != "" {
+		evt.Tags = append(evt.Tags, nostr.Tag{"e", replyTo})
+	}
+	if previous := g.previousTag(); previous != nil {
+		evt.Tags = append(evt.Tags, previous)
+	}
+
+	if _, err := prepareEvent(ctx, g.Address.Relay, &evt); err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+// Deliver publishes a message made by PrepareChatMessage. if it can't get to the relay the message goes
+// to the outbox and ErrQueued is returned, only messages the relay has refused are given up on. the message that was actually published is returned, as the
+// relay may have required more proof-of-work, which changes it.
+func (g *Group) Deliver(ctx context.Context, evt *nostr.Event) (*nostr.Event, error) {
+	relay, err := System.Pool.EnsureRelay(g.Address.Relay)
+	if err != nil {
+		slog.Warn("queueing message", "group", g.Address, "err", err)
+		queueMessage(g.Address, evt)
+		return evt, ErrQueued
+	}
+
+	published := *evt
+	published.Tags = slices.Clone(evt.Tags)
+	if err := publishPrepared(ctx, relay, &published, powDifficulty(ctx, g.Address.Relay)); err != nil {
+		if !strings.HasPrefix(err.Error(), "msg: ") {
+			// we've lost the connection or the relay didn't answer, which doesn't mean it won't take it later
+			slog.Warn("queueing message", "group", g.Address, "err", err)
+			queueMessage(g.Address, evt)
+			return evt, ErrQueued
+		}
+		return evt, fmt.Errorf("publish to %s failed: %w", g.Address, err)
+	}
+
+	unqueueMessage(g.Address, evt.ID)
+	g.see(&published)
+	return &published, nil
+}
+
+// flushOutbox tries to send the messages that were waiting for the relay, reporting through Delivered.
+// the lock is only there so two flushes don't send the same messages, nothing waits for whoever reads Delivered.
+func (g *Group) flushOutbox(ctx context.Context) {
+	if !g.flushing.TryLock() {
+		return
+	}
+	defer g.flushing.Unlock()
+
+	for _, evt := range g.Outbox() {
+		published, err := g.Deliver(ctx, evt)
+		if errors.Is(err, ErrQueued) {
+			// we've lost the connection again
+			return
+		}
+		if err != nil {
+			// the relay has refused it, so it's not waiting for anything anymore
+			unqueueMessage(g.Address, evt.ID)
+		}
+
+		g.Delivered.push(Delivery{ID: evt.ID, Event: published, Err: err})
+	}
+}
@@ -0,0 +1,96 @@
+package global
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// withTestOutbox makes the outbox start empty and be saved somewhere it can be thrown away.
+func withTestOutbox(t *testing.T) {
+	previousPath := outboxPath
+	t.Cleanup(func() {
+		outboxPath = previousPath
+		outbox = nil
+	})
+	outboxPath = filepath.Join(t.TempDir(), "outbox.json")
+	outbox = nil
+}
+
+func TestOutbox(t *testing.T) {
+	withTestOutbox(t)
+
+	gad := nip29.GroupAddress{Relay: "wss://groups.example.com", ID: "test"}
+	other := nip29.GroupAddress{Relay: "wss://groups.example.com", ID: "other"}
+	groups := map[nip29.GroupAddress]*Group{
+		gad:   {Group: nip29.Group{Address: gad}},
+		other: {Group: nip29.Group{Address: other}},
+	}
+	first := &nostr.Event{ID: testEventID(1), Kind: 9, CreatedAt: 1, Content: "first"}
+	second := &nostr.Event{ID: testEventID(2), Kind: 9, CreatedAt: 2, Content: "second"}
+	elsewhere := &nostr.Event{ID: testEventID(3), Kind: 9, CreatedAt: 3, Content: "elsewhere"}
+
+	for _, step := range []struct {
+		name   string
+		do     func()
+		queued map[nip29.GroupAddress][]string
+	}{
+		{
+			"queued in order",
+			func() {
+				queueMessage(gad, first)
+				queueMessage(gad, second)
+				queueMessage(other, elsewhere)
+			},
+			map[nip29.GroupAddress][]string{gad: {first.ID, second.ID}, other: {elsewhere.ID}},
+		},
+		{
+			"queued again when it fails again",
+			func() { queueMessage(gad, first) },
+			map[nip29.GroupAddress][]string{gad: {first.ID, second.ID}, other: {elsewhere.ID}},
+		},
+		{
+			"kept when the app is opened again",
+			func() { outbox = nil },
+			map[nip29.GroupAddress][]string{gad: {first.ID, second.ID}, other: {elsewhere.ID}},
+		},
+		{
+			"sent",
+			func() { unqueueMessage(gad, first.ID) },
+			map[nip29.GroupAddress][]string{gad: {second.ID}, other: {elsewhere.ID}},
+		},
+		{
+			"sent something that wasn't there",
+			func() { unqueueMessage(gad, elsewhere.ID) },
+			map[nip29.GroupAddress][]string{gad: {second.ID}, other: {elsewhere.ID}},
+		},
+		{
+			"discarded",
+			func() {
+				groups[gad].Discard(second.ID)
+				outbox = nil
+			},
+			map[nip29.GroupAddress][]string{gad: nil, other: {elsewhere.ID}},
+		},
+	} {
+		step.do()
+		for address, want := range step.queued {
+			queued := make([]string, 0, len(want))
+			for _, evt := range groups[address].Outbox() {
+				queued = append(queued, evt.ID)
+			}
+			if !slices.Equal(queued, want) {
+				t.Errorf("%s: %s has %v queued, want %v", step.name, address, queued, want)
+			}
+		}
+	}
+
+	// the messages come back from disk as they were
+	outbox = nil
+	if queued := groups[other].Outbox(); len(queued) != 1 || queued[0].Content != elsewhere.Content {
+		t.Errorf("%v was read back, want %v", queued, elsewhere)
+	}
+}
@@ -0,0 +1,157 @@
+package global
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// join requests that are waiting for an admin to approve them are kept on disk so we
+// keep waiting for the approval after the app is restarted
+var (
+	pendingJoinsPath, _ = homedir.Expand("~/.local/share/shiitake/pending-joins.json")
+	pendingJoins        = make(map[string]nostr.Timestamp) // when we've asked to join, by group address
+	pendingJoinsLock    sync.Mutex
+	pendingWatchers     = make(map[string]context.CancelFunc) // stops waiting for the approval, by group address
+)
+
+func loadPendingJoins() map[string]nostr.Timestamp {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+
+	if b, err := os.ReadFile(pendingJoinsPath); err == nil {
+		if err := json.Unmarshal(b, &pendingJoins); err != nil {
+			slog.Warn("failed to read pending join requests", "err", err)
+		}
+	}
+
+	result := make(map[string]nostr.Timestamp, len(pendingJoins))
+	for gad, since := range pendingJoins {
+		result[gad] = since
+	}
+	return result
+}
+
+func setJoinPending(gad nip29.GroupAddress, since nostr.Timestamp) {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+
+	if since == 0 {
+		if stop, ok := pendingWatchers[gad.String()]; ok {
+			stop()
+			delete(pendingWatchers, gad.String())
+		}
+		if _, ok := pendingJoins[gad.String()]; !ok {
+			return
+		}
+		delete(pendingJoins, gad.String())
+	} else {
+		pendingJoins[gad.String()] = since
+	}
+
+	b, _ := json.Marshal(pendingJoins)
+	os.MkdirAll(filepath.Dir(pendingJoinsPath), 0755)
+	if err := os.WriteFile(pendingJoinsPath, b, 0644); err != nil {
+		slog.Warn("failed to save pending join requests", "err", err)
+	}
+
+	if me != nil {
+		me.triggerListUpdate()
+	}
+}
+
+// IsJoinPending tells if we have asked to join this group and are still waiting for an answer.
+func (me *Me) IsJoinPending(gad nip29.GroupAddress) bool {
+	pendingJoinsLock.Lock()
+	defer pendingJoinsLock.Unlock()
+	_, ok := pendingJoins[gad.String()]
+	return ok
+}
+
+// CancelJoinRequest stops waiting for the approval of a request to join a group and tells the relay
+// we don't want to join anymore, so the admins don't approve it later.
+func CancelJoinRequest(ctx context.Context, gad nip29.GroupAddress) error {
+	setJoinPending(gad, 0)
+
+	leaveRequest := nostr.Event{
+		Kind:      nostr.KindSimpleGroupLeaveRequest,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{nostr.Tag{"h", gad.ID}},
+	}
+	if err := publishToGroup(ctx, gad, &leaveRequest); err != nil && !strings.Contains(err.Error(), "not a member") {
+		return err
+	}
+	return nil
+}
+
+// startWatchingPendingJoin runs watchPendingJoin until the request is answered or it isn't pending anymore.
+func startWatchingPendingJoin(gad nip29.GroupAddress, since nostr.Timestamp) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pendingJoinsLock.Lock()
+	if stop, ok := pendingWatchers[gad.String()]; ok {
+		stop()
+	}
+	pendingWatchers[gad.String()] = cancel
+	pendingJoinsLock.Unlock()
+
+	go watchPendingJoin(ctx, gad, since)
+}
+
+// watchPendingJoin waits for the relay to add us to a group we've asked to join, then adds it to our list.
+// if the relay removes us instead our request was turned down and we stop waiting.
+func watchPendingJoin(ctx context.Context, gad nip29.GroupAddress, since nostr.Timestamp) {
+	delay := minReconnectDelay
+
+	for {
+		if relay, err := System.Pool.EnsureRelay(gad.Relay); err != nil {
+			slog.Warn("connect error", "relay", gad.Relay, "err", err)
+		} else if sub, err := relay.Subscribe(ctx, nostr.Filters{
+			{
+				Kinds: []int{nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser},
+				Tags: nostr.TagMap{
+					"h": []string{gad.ID},
+					"p": []string{me.PubKey},
+				},
+				Since: &since,
+			},
+		}); err != nil {
+			slog.Warn("subscription error", "relay", gad.Relay, "err", err)
+		} else {
+			select {
+			case evt, ok := <-sub.Events:
+				sub.Unsub()
+				if ok && evt.Kind == nostr.KindSimpleGroupRemoveUser {
+					slog.Info("join request turned down", "group", gad)
+					setJoinPending(gad, 0)
+					return
+				}
+				if ok {
+					// adding it to the list stops this watcher, which must not stop the list from being published
+					if err := addToLastList(context.WithoutCancel(ctx), gad); err != nil {
+						slog.Warn("failed to add approved group to list", "group", gad, "err", err)
+					}
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+			delay = min(delay*2, maxReconnectDelay)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package global
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+// the proof-of-work difficulty relays have told us they require when rejecting our events,
+// for those that don't announce it in their NIP-11 document, by relay url
+var learnedPoWDifficulties = xsync.NewMapOf[string, int]()
+
+var numbersInReason = regexp.MustCompile(`\d+`)
+
+type workStartedKey struct{}
+
+// WithWorkStarted makes fn be called whenever an event published with the returned context needs
+// proof-of-work, with the difficulty that is being worked on. cancel the context to stop the work.
+func WithWorkStarted(ctx context.Context, fn func(difficulty int)) context.Context {
+	return context.WithValue(ctx, workStartedKey{}, fn)
+}
+
+// powDifficulty is the proof-of-work our events must have in order to be accepted by a relay.
+func powDifficulty(ctx context.Context, url string) int {
+	difficulty, _ := learnedPoWDifficulties.Load(nostr.NormalizeURL(url))
+	if info, err := relayInfo(ctx, url); err == nil && info.Limitation != nil {
+		difficulty = max(difficulty, info.Limitation.MinPowDifficulty)
+	}
+	return difficulty
+}
+
+// learnPoWDifficulty takes the difficulty a relay requires from the reason it gave for rejecting an
+// event, like "pow: difficulty 12 is less than 20". it returns 0 if the reason isn't about proof-of-work.
+func learnPoWDifficulty(url string, reason string) int {
+	_, after, found := strings.Cut(reason, "pow:")
+	if !found {
+		return 0
+	}
+
+	difficulty := 0
+	for _, number := range numbersInReason.FindAllString(after, -1) {
+		if n, err := strconv.Atoi(number); err == nil && n <= 256 {
+			difficulty = max(difficulty, n)
+		}
+	}
+	if difficulty > 0 {
+		learnedPoWDifficulties.Store(nostr.NormalizeURL(url), difficulty)
+	}
+	return difficulty
+}
+
+// doWork mines a nonce for the event (NIP-13), which must be signed afterwards.
+func doWork(ctx context.Context, evt *nostr.Event, difficulty int) error {
+	pubkey, err := K.GetPublicKey(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get our public key: %w", err)
+	}
+	evt.PubKey = pubkey
+
+	// a nonce from a previous attempt with a lower difficulty is no good
+	evt.Tags = slices.DeleteFunc(evt.Tags, func(tag nostr.Tag) bool { return len(tag) >= 1 && tag[0] == "nonce" })
+
+	if notify, ok := ctx.Value(workStartedKey{}).(func(int)); ok {
+		notify(difficulty)
+	}
+
+	slog.Info("doing proof-of-work", "kind", evt.Kind, "difficulty", difficulty)
+	nonce, err := nip13.DoWork(ctx, *evt, difficulty)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("proof-of-work stopped: %w", ctx.Err())
+		}
+		return fmt.Errorf("proof-of-work failed: %w", err)
+	}
+
+	evt.Tags = append(evt.Tags, nonce)
+	return nil
+}
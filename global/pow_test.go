@@ -0,0 +1,106 @@
+package global
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+func TestLearnPoWDifficulty(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reason string
+		want   int
+	}{
+		{"required after the given", "pow: difficulty 12 is less than 20", 20},
+		{"only the required", "pow: required difficulty 16", 16},
+		{"with the prefix the library adds", "msg: pow: difficulty 10 is less than 24", 24},
+		{"numbers before the prefix are ignored", "rate-limited 300 times, pow: need 8", 8},
+		{"not about proof-of-work", "blocked: you are banned", 0},
+		{"no numbers", "pow: not enough work", 0},
+		{"impossible difficulty", "pow: difficulty 300 required", 0},
+		{"empty", "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			url := fmt.Sprintf("wss://%s.example.com", strings.ReplaceAll(tc.name, " ", "-"))
+			learnedPoWDifficulties.Delete(nostr.NormalizeURL(url))
+
+			if got := learnPoWDifficulty(url, tc.reason); got != tc.want {
+				t.Errorf("learnPoWDifficulty(%q) = %d, want %d", tc.reason, got, tc.want)
+			}
+
+			learned, ok := learnedPoWDifficulties.Load(nostr.NormalizeURL(url))
+			if tc.want == 0 && ok {
+				t.Errorf("learned %d from %q, want nothing", learned, tc.reason)
+			}
+			if tc.want != 0 && learned != tc.want {
+				t.Errorf("learned %d from %q, want %d", learned, tc.reason, tc.want)
+			}
+		})
+	}
+}
+
+func TestDoWork(t *testing.T) {
+	signer, err := keyer.NewPlainKeySigner(nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := K
+	t.Cleanup(func() { K = previous })
+	K = signer
+	pubkey, _ := signer.GetPublicKey(context.Background())
+
+	for _, tc := range []struct {
+		name       string
+		tags       nostr.Tags
+		difficulty int
+	}{
+		{"no work", nostr.Tags{{"h", "abc"}}, 0},
+		{"some work", nostr.Tags{{"h", "abc"}}, 8},
+		{"replaces a previous nonce", nostr.Tags{{"h", "abc"}, {"nonce", "123", "4"}}, 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := &nostr.Event{Kind: 9, CreatedAt: nostr.Now(), Tags: tc.tags, Content: "hello"}
+
+			notified := -1
+			ctx := WithWorkStarted(context.Background(), func(difficulty int) { notified = difficulty })
+			if err := doWork(ctx, evt, tc.difficulty); err != nil {
+				t.Fatalf("doWork: %s", err)
+			}
+
+			if evt.PubKey != pubkey {
+				t.Errorf("pubkey is %q, want %q", evt.PubKey, pubkey)
+			}
+			if notified != tc.difficulty {
+				t.Errorf("notified of difficulty %d, want %d", notified, tc.difficulty)
+			}
+			nonces := 0
+			for _, tag := range evt.Tags {
+				if tag[0] == "nonce" {
+					nonces++
+				}
+			}
+			if nonces != 1 {
+				t.Errorf("%d nonce tags, want 1", nonces)
+			}
+			if got := nip13.Difficulty(evt.GetID()); got < tc.difficulty {
+				t.Errorf("difficulty is %d, want at least %d", got, tc.difficulty)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		evt := &nostr.Event{Kind: 9, CreatedAt: nostr.Now(), Content: "hello"}
+		if err := doWork(ctx, evt, 256); err == nil {
+			t.Fatal("doWork succeeded with a canceled context")
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package global
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-29 "previous" tags reference some of the latest events seen in a group, so events taken
+// out of their context (replayed from elsewhere, or from a forked timeline) can be detected.
+const (
+	previousWindow     = 50 // references must be to one of this many latest events
+	previousReferences = 3  // how many references we put in our events
+)
+
+type seenEvent struct {
+	id        string
+	createdAt nostr.Timestamp
+}
+
+// see takes note of an event that belongs to the group timeline.
+func (g *Group) see(evt *nostr.Event) {
+	if evt.Tags.GetFirst([]string{"h", g.Address.ID}) == nil {
+		return
+	}
+	// we reference events by the start of their ids, which a relay could send us too short
+	if !nostr.IsValid32ByteHex(evt.ID) {
+		return
+	}
+
+	g.timeline.Lock()
+	defer g.timeline.Unlock()
+
+	if g.timeline.seen == nil {
+		g.timeline.seen = make(map[string]nostr.Timestamp)
+	}
+	if _, ok := g.timeline.seen[evt.ID[0:8]]; ok {
+		return
+	}
+	g.timeline.seen[evt.ID[0:8]] = evt.CreatedAt
+
+	// keep only the latest ones, oldest first, and just count the ones that don't fit anymore
+	latest := g.timeline.latest
+	i := sort.Search(len(latest), func(i int) bool { return latest[i].createdAt > evt.CreatedAt })
+	g.timeline.latest = slices.Insert(latest, i, seenEvent{evt.ID, evt.CreatedAt})
+	if len(g.timeline.latest) > previousWindow {
+		g.timeline.latest = slices.Delete(g.timeline.latest, 0, 1)
+		g.timeline.forgotten++
+	}
+}
+
+// previousTag references a few of the latest events we've seen, it is nil if we haven't seen any.
+func (g *Group) previousTag() nostr.Tag {
+	g.timeline.Lock()
+	defer g.timeline.Unlock()
+
+	if len(g.timeline.latest) == 0 {
+		return nil
+	}
+
+	tag := nostr.Tag{"previous"}
+	for _, i := range rand.Perm(len(g.timeline.latest)) {
+		if len(tag) > previousReferences {
+			break
+		}
+		tag = append(tag, g.timeline.latest[i].id[0:8])
+	}
+	return tag
+}
+
+// UnknownPrevious returns the references in the "previous" tag of an event that point to events
+// we haven't seen in this group. events are only judged once we have seen enough of the timeline
+// that came before them, otherwise nothing is returned. that can only be told for events that are
+// not older than the latest ones we remember, so older events are never judged.
+//
+// we only follow messages, reactions and moderation events, so a reference to an event of any
+// other kind is reported too.
+func (g *Group) UnknownPrevious(evt *nostr.Event) []string {
+	tag := evt.Tags.GetFirst([]string{"previous"})
+	if tag == nil || len(*tag) < 2 {
+		return nil
+	}
+
+	g.timeline.Lock()
+	defer g.timeline.Unlock()
+
+	latest := g.timeline.latest
+	if len(latest) == 0 || evt.CreatedAt < latest[0].createdAt {
+		return nil
+	}
+	older := g.timeline.forgotten + sort.Search(len(latest), func(i int) bool { return latest[i].createdAt > evt.CreatedAt })
+	if older <= previousWindow {
+		return nil
+	}
+
+	var unknown []string
+	for _, ref := range (*tag)[1:] {
+		if _, ok := g.timeline.seen[ref[0:min(8, len(ref))]]; !ok {
+			unknown = append(unknown, ref)
+		}
+	}
+	return unknown
+}
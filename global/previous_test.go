@@ -0,0 +1,109 @@
+package global
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+func testEventID(i int) string { return fmt.Sprintf("%08x%056d", i, 0) }
+
+// testTimeline makes a group that has seen n events, created at 1, 2, ... n.
+func testTimeline(n int) *Group {
+	g := &Group{Group: nip29.Group{Address: nip29.GroupAddress{Relay: "wss://groups.example.com", ID: "test"}}}
+	for i := 1; i <= n; i++ {
+		g.see(&nostr.Event{
+			ID:        testEventID(i),
+			CreatedAt: nostr.Timestamp(i),
+			Tags:      nostr.Tags{{"h", "test"}},
+		})
+	}
+	return g
+}
+
+func TestPreviousTag(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		seen   int
+		length int
+	}{
+		{"nothing seen", 0, 0},
+		{"fewer than the references", 2, 3},
+		{"more than the window", 120, 1 + previousReferences},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tag := testTimeline(tc.seen).previousTag()
+			if len(tag) != tc.length {
+				t.Fatalf("tag is %v, want %d items", tag, tc.length)
+			}
+			if tag == nil {
+				return
+			}
+			if tag[0] != "previous" {
+				t.Errorf("tag is %v, want a previous tag", tag)
+			}
+
+			for i, ref := range tag[1:] {
+				if len(ref) != 8 {
+					t.Errorf("reference %q isn't 8 characters long", ref)
+				}
+				if slices.Index(tag[1:], ref) != i {
+					t.Errorf("reference %q is repeated in %v", ref, tag)
+				}
+				// only the latest events may be referenced
+				var n int
+				fmt.Sscanf(ref, "%x", &n)
+				if n <= tc.seen-previousWindow {
+					t.Errorf("reference %q is to event %d, which isn't one of the latest %d", ref, n, previousWindow)
+				}
+			}
+		})
+	}
+}
+
+func TestSeeInvalidID(t *testing.T) {
+	g := testTimeline(2)
+	for _, id := range []string{"", "abc", strings.Repeat("z", 64)} {
+		g.see(&nostr.Event{ID: id, CreatedAt: 3, Tags: nostr.Tags{{"h", "test"}}})
+	}
+	if tag := g.previousTag(); len(tag) != 3 {
+		t.Errorf("tag is %v, want only the 2 valid events", tag)
+	}
+}
+
+func TestUnknownPrevious(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		seen      int
+		createdAt nostr.Timestamp
+		previous  nostr.Tag
+		want      []string
+	}{
+		{"no previous tag", 100, 101, nil, nil},
+		{"empty previous tag", 100, 101, nostr.Tag{"previous"}, nil},
+		{"all known", 100, 101, nostr.Tag{"previous", testEventID(99)[0:8], testEventID(70)[0:8]}, nil},
+		{"some unknown", 100, 101, nostr.Tag{"previous", testEventID(99)[0:8], "deadbeef"}, []string{"deadbeef"}},
+		{"full ids", 100, 101, nostr.Tag{"previous", testEventID(99), "deadbeefdeadbeef"}, []string{"deadbeefdeadbeef"}},
+		{"short reference", 100, 101, nostr.Tag{"previous", "dead"}, []string{"dead"}},
+		{"references to forgotten events are known", 100, 101, nostr.Tag{"previous", testEventID(3)[0:8]}, nil},
+		{"exactly the window before it", previousWindow, previousWindow + 1, nostr.Tag{"previous", "deadbeef"}, nil},
+		{"one more than the window before it", previousWindow + 1, previousWindow + 2, nostr.Tag{"previous", "deadbeef"}, []string{"deadbeef"}},
+		{"in the window", 100, 75, nostr.Tag{"previous", "deadbeef"}, []string{"deadbeef"}},
+		{"older than the window", 100, 10, nostr.Tag{"previous", "deadbeef"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := &nostr.Event{ID: testEventID(1000), CreatedAt: tc.createdAt, Tags: nostr.Tags{{"h", "test"}}}
+			if tc.previous != nil {
+				evt.Tags = append(evt.Tags, tc.previous)
+			}
+
+			if got := testTimeline(tc.seen).UnknownPrevious(evt); !slices.Equal(got, tc.want) {
+				t.Errorf("UnknownPrevious(%v) = %v, want %v", tc.previous, got, tc.want)
+			}
+		})
+	}
+}
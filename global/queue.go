@@ -0,0 +1,52 @@
+package global
+
+import (
+	"context"
+	"sync"
+)
+
+// Queue passes things from the relay subscriptions to whoever displays them. pushing never blocks,
+// so a group that isn't being displayed doesn't stop following its relay: what is pushed is kept
+// until someone reads it. the zero value is ready to use.
+type Queue[T any] struct {
+	mu      sync.Mutex
+	items   []T
+	waiting chan struct{} // closed when something is pushed
+}
+
+func (q *Queue[T]) push(item T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, item)
+	if q.waiting != nil {
+		close(q.waiting)
+		q.waiting = nil
+	}
+}
+
+// Next waits for the next item, ok is false if ctx is canceled first.
+func (q *Queue[T]) Next(ctx context.Context) (item T, ok bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			item = q.items[0]
+			var zero T
+			q.items[0] = zero
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return item, true
+		}
+		if q.waiting == nil {
+			q.waiting = make(chan struct{})
+		}
+		waiting := q.waiting
+		q.mu.Unlock()
+
+		select {
+		case <-waiting:
+		case <-ctx.Done():
+			return item, false
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package global
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// applyReaction takes a reaction or a deletion of a reaction, it returns the ids of the messages
+// whose reactions have changed.
+func (g *Group) applyReaction(evt *nostr.Event) []string {
+	g.reactions.Lock()
+	defer g.reactions.Unlock()
+
+	if g.reactions.byTarget == nil {
+		g.reactions.byTarget = make(map[string][]*nostr.Event, 100)
+		g.reactions.targets = make(map[string]string, 100)
+	}
+
+	switch evt.Kind {
+	case nostr.KindReaction:
+		if _, exists := g.reactions.targets[evt.ID]; exists {
+			return nil
+		}
+
+		tag := evt.Tags.GetLast([]string{"e", ""})
+		if tag == nil {
+			return nil
+		}
+		target := (*tag)[1]
+
+		g.reactions.targets[evt.ID] = target
+		g.reactions.byTarget[target] = append(g.reactions.byTarget[target], evt)
+		return []string{target}
+	case nostr.KindDeletion:
+		changed := make([]string, 0, 1)
+		for _, tag := range evt.Tags {
+			if len(tag) < 2 || tag[0] != "e" {
+				continue
+			}
+			target, ok := g.reactions.targets[tag[1]]
+			if !ok {
+				continue
+			}
+
+			// we keep the reaction in targets so it isn't added back if the relay sends it again
+			g.reactions.byTarget[target] = slices.DeleteFunc(g.reactions.byTarget[target], func(reaction *nostr.Event) bool {
+				// only the author of a reaction can delete it
+				return reaction.ID == tag[1] && reaction.PubKey == evt.PubKey
+			})
+			changed = append(changed, target)
+		}
+		return changed
+	}
+
+	return nil
+}
+
+// handleReaction applies a reaction (or the deletion of one) and tells whoever is displaying the messages.
+func (g *Group) handleReaction(evt *nostr.Event) {
+	changed := g.applyReaction(evt)
+
+	g.reactions.Lock()
+	listeners := slices.Clone(g.reactions.listeners)
+	g.reactions.Unlock()
+
+	for _, target := range changed {
+		for _, fn := range listeners {
+			fn(target)
+		}
+	}
+}
+
+// ReactionsTo returns the reactions a message has, in the order they were received.
+func (g *Group) ReactionsTo(id string) []*nostr.Event {
+	g.reactions.Lock()
+	defer g.reactions.Unlock()
+	return slices.Clone(g.reactions.byTarget[id])
+}
+
+// OnReactionsChanged calls fn with the id of a message whenever its reactions change.
+// fn is called from the relay subscription, so it must not block.
+func (g *Group) OnReactionsChanged(fn func(id string)) {
+	g.reactions.Lock()
+	defer g.reactions.Unlock()
+	g.reactions.listeners = append(g.reactions.listeners, fn)
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	neturl "net/url"
 	"sync"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip11"
@@ -13,7 +14,21 @@ import (
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
-var relays = xsync.NewMapOf[string, *Relay]()
+var (
+	relays     = xsync.NewMapOf[string, *Relay]()
+	relayInfos = xsync.NewMapOf[string, nip11.RelayInformationDocument]() // NIP-11 documents, by relay url
+
+	// the last failure to get the NIP-11 document of each relay, by relay url. we don't try again for a while,
+	// as it's needed before sending every event and each attempt can take seconds.
+	relayInfoFailures = xsync.NewMapOf[string, relayInfoFailure]()
+)
+
+const relayInfoRetryDelay = time.Minute
+
+type relayInfoFailure struct {
+	err error
+	at  time.Time
+}
 
 type Relay struct {
 	URL   string
@@ -45,6 +60,7 @@ func LoadRelay(ctx context.Context, url string) (*Relay, error) {
 		return nil, fmt.Errorf("failed to get information from '%s': %w", url, err)
 	}
 
+	relayInfos.Store(url, info)
 	relay.Image = info.Icon
 	relay.Name = info.Name
 	parsed, _ := neturl.Parse(url)
@@ -64,6 +80,10 @@ func LoadRelay(ctx context.Context, url string) (*Relay, error) {
 		res, _ := r.QuerySync(ctx, nostr.Filter{Kinds: []int{39000}, Limit: 10})
 		relay.GroupsList = make([]nip29.Group, 0, len(res))
 		for _, evt := range res {
+			if info.PubKey != "" && evt.PubKey != info.PubKey {
+				slog.Warn("group metadata not signed by the relay", "event", evt)
+				continue
+			}
 			group, err := nip29.NewGroupFromMetadataEvent(url, evt)
 			if err != nil {
 				slog.Warn("invalid group metadata received", "event", evt)
@@ -76,3 +96,39 @@ func LoadRelay(ctx context.Context, url string) (*Relay, error) {
 
 	return relay, nil
 }
+
+// RelayPubKey returns the pubkey a relay announces in its NIP-11 document, which is
+// the key that must sign the metadata of the groups it hosts. it is empty if the relay
+// doesn't announce any.
+func RelayPubKey(ctx context.Context, url string) (string, error) {
+	info, err := relayInfo(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	return info.PubKey, nil
+}
+
+// relayInfo returns the NIP-11 document of a relay, it is only fetched once. if that fails the
+// same error is returned until relayInfoRetryDelay has passed.
+func relayInfo(ctx context.Context, url string) (nip11.RelayInformationDocument, error) {
+	url = nostr.NormalizeURL(url)
+	if info, ok := relayInfos.Load(url); ok {
+		return info, nil
+	}
+	if failure, ok := relayInfoFailures.Load(url); ok && time.Since(failure.at) < relayInfoRetryDelay {
+		return nip11.RelayInformationDocument{URL: url}, failure.err
+	}
+
+	info, err := nip11.Fetch(ctx, url)
+	if err != nil {
+		err = fmt.Errorf("failed to get information from '%s': %w", url, err)
+		// unless we gave up because we were told to, which says nothing about the relay
+		if ctx.Err() == nil {
+			relayInfoFailures.Store(url, relayInfoFailure{err, time.Now()})
+		}
+		return info, err
+	}
+	relayInfos.Store(url, info)
+	relayInfoFailures.Delete(url)
+	return info, nil
+}
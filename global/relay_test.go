@@ -0,0 +1,90 @@
+package global
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRelayInfoFailures(t *testing.T) {
+	var requests atomic.Int32
+	var available atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !available.Load() {
+			http.Error(w, "not now", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/nostr+json")
+		w.Write([]byte(`{"name": "test", "pubkey": "` + testEventID(1) + `"}`))
+	}))
+	defer server.Close()
+
+	url := nostr.NormalizeURL(server.URL)
+	t.Cleanup(func() {
+		relayInfos.Delete(url)
+		relayInfoFailures.Delete(url)
+	})
+	// as if we had tried a while ago
+	retryNow := func() {
+		failure, _ := relayInfoFailures.Load(url)
+		failure.at = failure.at.Add(-relayInfoRetryDelay)
+		relayInfoFailures.Store(url, failure)
+	}
+
+	ctx := context.Background()
+	for _, step := range []struct {
+		name      string
+		before    func()
+		available bool
+		wantErr   bool
+		requests  int32
+	}{
+		{"fails", nil, false, true, 1},
+		{"the failure is remembered", nil, true, true, 1},
+		{"tried again after a while", retryNow, false, true, 2},
+		{"works after a while", retryNow, true, false, 3},
+		{"the document is remembered", nil, false, false, 3},
+	} {
+		if step.before != nil {
+			step.before()
+		}
+		available.Store(step.available)
+
+		_, err := relayInfo(ctx, url)
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: relayInfo err = %v, want an error: %v", step.name, err, step.wantErr)
+		}
+		if requests.Load() != step.requests {
+			t.Errorf("%s: the relay got %d requests, want %d", step.name, requests.Load(), step.requests)
+		}
+	}
+
+	if _, ok := relayInfoFailures.Load(url); ok {
+		t.Errorf("the failure is still remembered after it has worked")
+	}
+}
+
+func TestRelayInfoCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	url := nostr.NormalizeURL(server.URL)
+	t.Cleanup(func() { relayInfoFailures.Delete(url) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := relayInfo(ctx, url); err == nil {
+		t.Fatal("relayInfo didn't fail")
+	}
+	if _, ok := relayInfoFailures.Load(url); ok {
+		t.Errorf("giving up was remembered as a failure of the relay")
+	}
+}
@@ -1,12 +1,27 @@
 package global
 
-import "context"
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr/nip05"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
 
 func SearchUsers(ctx context.Context, query string) []User {
 	res := System.SearchUsers(ctx, query)
-	users := make([]User, len(res))
-	for i, r := range res {
-		users[i] = User{r}
+	users := make([]User, 0, len(res)+1)
+
+	// an exact npub or nip05 address goes first, as that's certainly who is being searched for
+	if prefix, value, err := nip19.Decode(query); err == nil && prefix == "npub" {
+		users = append(users, GetUser(ctx, value.(string)))
+	} else if nip05.IsValidIdentifier(query) {
+		if pp, err := nip05.QueryIdentifier(ctx, query); err == nil {
+			users = append(users, GetUser(ctx, pp.PublicKey))
+		}
+	}
+
+	for _, r := range res {
+		users = append(users, User{r})
 	}
 	return users
 }
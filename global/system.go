@@ -2,10 +2,12 @@ package global
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/fiatjaf/eventstore/badger"
 	"github.com/mitchellh/go-homedir"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/keyer"
 	"github.com/nbd-wtf/go-nostr/sdk"
 )
@@ -30,6 +32,9 @@ func Init(ctx context.Context, keyOrBunker string, password string) error {
 		K = k
 	}
 
+	// relays that we reach through the pool can ask us to authenticate
+	nostr.WithAuthHandler(handleAuthRequest).ApplyPoolOption(System.Pool)
+
 	close(initialized)
 
 	return nil
@@ -40,3 +45,37 @@ func GetUser(ctx context.Context, pubkey string) User {
 		ProfileMetadata: System.FetchProfileMetadata(ctx, pubkey),
 	}
 }
+
+var (
+	pendingUsers     = make(map[string][]func(User))
+	pendingUsersLock sync.Mutex
+)
+
+// RequestUser calls fn with the user metadata once it is loaded, without blocking. All the requests for
+// the same pubkey that happen while it is being loaded are answered by the same fetch, and fetches that
+// happen around the same time are batched together by the system loader.
+//
+// fn is called from a different goroutine.
+func RequestUser(ctx context.Context, pubkey string, fn func(User)) {
+	pendingUsersLock.Lock()
+	callbacks, alreadyLoading := pendingUsers[pubkey]
+	pendingUsers[pubkey] = append(callbacks, fn)
+	pendingUsersLock.Unlock()
+
+	if alreadyLoading {
+		return
+	}
+
+	go func() {
+		user := GetUser(ctx, pubkey)
+
+		pendingUsersLock.Lock()
+		callbacks := pendingUsers[pubkey]
+		delete(pendingUsers, pubkey)
+		pendingUsersLock.Unlock()
+
+		for _, fn := range callbacks {
+			fn(user)
+		}
+	}()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+
+	"fiatjaf.com/nostr-gtk/components/profile"
+	"fiatjaf.com/shiitake/global"
+	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
+	"github.com/diamondburned/gotkit/app/locale"
+	"github.com/dustin/go-humanize"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// the activity timeline can be filtered to show only one of these kinds of events
+var activityFilters = []struct {
+	name  string
+	kinds []int
+}{
+	{"Everything", nil},
+	{"Members", []int{
+		nostr.KindSimpleGroupPutUser,
+		nostr.KindSimpleGroupRemoveUser,
+		nostr.KindSimpleGroupJoinRequest,
+		nostr.KindSimpleGroupLeaveRequest,
+	}},
+	{"Group Details", []int{
+		nostr.KindSimpleGroupEditMetadata,
+		nostr.KindSimpleGroupCreateGroup,
+		nostr.KindSimpleGroupDeleteGroup,
+	}},
+	{"Deleted Messages", []int{nostr.KindSimpleGroupDeleteEvent}},
+	{"Invites", []int{nostr.KindSimpleGroupCreateInvite}},
+}
+
+// newActivityPage creates the timeline of moderation events, filled by addActivity.
+func (v *GroupView) newActivityPage() gtk.Widgetter {
+	names := make([]string, len(activityFilters))
+	for i, filter := range activityFilters {
+		names[i] = filter.name
+	}
+	filter := gtk.NewDropDownFromStrings(names)
+	filter.SetHAlign(gtk.AlignEnd)
+	filter.AddCSSClass("mb-4")
+
+	v.activity.list = gtk.NewListBox()
+	v.activity.list.SetSelectionMode(gtk.SelectionNone)
+	v.activity.list.AddCSSClass("boxed-list")
+	v.activity.list.SetVAlign(gtk.AlignStart)
+
+	empty := adw.NewStatusPage()
+	empty.SetTitle("No Activity")
+	empty.SetIconName("document-open-recent-symbolic")
+	v.activity.list.SetPlaceholder(empty)
+
+	// newest first
+	v.activity.list.SetSortFunc(func(a, b *gtk.ListBoxRow) int {
+		return int(v.activity.events[glib.BaseObject(b).Native()].CreatedAt - v.activity.events[glib.BaseObject(a).Native()].CreatedAt)
+	})
+	v.activity.list.SetFilterFunc(func(row *gtk.ListBoxRow) bool {
+		kinds := activityFilters[filter.Selected()].kinds
+		return kinds == nil || slices.Contains(kinds, v.activity.events[glib.BaseObject(row).Native()].Kind)
+	})
+	filter.NotifyProperty("selected", v.activity.list.InvalidateFilter)
+
+	box := gtk.NewBox(gtk.OrientationVertical, 0)
+	box.AddCSSClass("p-8")
+	box.Append(filter)
+	box.Append(v.activity.list)
+
+	wrap := gtk.NewScrolledWindow()
+	wrap.SetVExpand(true)
+	wrap.SetHExpand(true)
+	wrap.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+	wrap.SetChild(box)
+
+	return wrap
+}
+
+// addActivity puts a moderation event or a join/leave request in the activity timeline.
+func (v *GroupView) addActivity(evt *nostr.Event) {
+	if _, seen := v.activity.seen[evt.ID]; seen {
+		return
+	}
+	v.activity.seen[evt.ID] = struct{}{}
+
+	description := gtk.NewLabel("")
+	description.SetXAlign(0)
+	description.SetWrap(true)
+	description.SetWrapMode(pango.WrapWordChar)
+	description.SetHExpand(true)
+
+	// names are links that show the profile of the member
+	names := make(map[string]string)
+	for _, pubkey := range activityPubKeys(evt) {
+		npub, _ := nip19.EncodePublicKey(pubkey)
+		names[pubkey] = npub[0:12] + "…"
+	}
+	description.SetMarkup(describeActivity(evt, names))
+	description.ConnectActivateLink(func(uri string) bool {
+		if pubkey, ok := strings.CutPrefix(uri, "pubkey:"); ok {
+			v.showProfilePopover(description, pubkey)
+		}
+		if id, ok := strings.CutPrefix(uri, "event:"); ok {
+			v.pages.SetVisibleChildName("chat")
+			v.ScrollToMessage(id)
+		}
+		return true
+	})
+	for pubkey := range names {
+		global.RequestUser(v.ctx, pubkey, func(user global.User) {
+			glib.IdleAdd(func() {
+				names[pubkey] = user.ShortName()
+				description.SetMarkup(describeActivity(evt, names))
+			})
+		})
+	}
+
+	when := gtk.NewLabel(humanize.Time(evt.CreatedAt.Time()))
+	when.SetTooltipText(locale.Time(evt.CreatedAt.Time(), true))
+	when.AddCSSClass("text-xs")
+	when.AddCSSClass("dim-label")
+	when.SetXAlign(0)
+
+	details := gtk.NewBox(gtk.OrientationVertical, 0)
+	details.Append(description)
+	if evt.Content != "" {
+		reason := gtk.NewLabel(evt.Content)
+		reason.AddCSSClass("italic")
+		reason.SetXAlign(0)
+		reason.SetWrap(true)
+		reason.SetSelectable(true)
+		details.Append(reason)
+	}
+	details.Append(when)
+
+	source := gtk.NewButtonFromIconName("text-x-generic-symbolic")
+	source.SetTooltipText(locale.Get("Show Source"))
+	source.AddCSSClass("flat")
+	source.SetVAlign(gtk.AlignCenter)
+	source.ConnectClicked(func() {
+		(&message{ctx: v.ctx, Event: evt}).ShowSource()
+	})
+
+	box := gtk.NewBox(gtk.OrientationHorizontal, 0)
+	box.AddCSSClass("p-2")
+	box.Append(details)
+	box.Append(source)
+
+	row := gtk.NewListBoxRow()
+	row.SetChild(box)
+	v.activity.events[glib.BaseObject(row).Native()] = evt
+	v.activity.list.Append(row)
+}
+
+// showProfilePopover displays a member next to the widget that references them.
+func (v *GroupView) showProfilePopover(parent gtk.Widgetter, pubkey string) {
+	npub, _ := nip19.EncodePublicKey(pubkey)
+	npubLabel := gtk.NewLabel(npub)
+	npubLabel.SetSelectable(true)
+	npubLabel.SetEllipsize(pango.EllipsizeMiddle)
+	npubLabel.SetMaxWidthChars(24)
+
+	p := profile.New(v.ctx, global.System, pubkey, npubLabel)
+	p.AddCSSClass("p-2")
+
+	popover := gtk.NewPopover()
+	popover.SetChild(p)
+	popover.SetParent(parent)
+	popover.ConnectClosed(popover.Unparent)
+	popover.Popup()
+}
+
+// activityPubKeys returns everybody that is mentioned in the description of an event, the author first.
+func activityPubKeys(evt *nostr.Event) []string {
+	pubkeys := []string{evt.PubKey}
+	for _, tag := range evt.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) && !slices.Contains(pubkeys, tag[1]) {
+			pubkeys = append(pubkeys, tag[1])
+		}
+	}
+	return pubkeys
+}
+
+// describeActivity writes what happened in a moderation event as pango markup, names is used to display
+// the people involved.
+func describeActivity(evt *nostr.Event, names map[string]string) string {
+	link := func(pubkey string) string {
+		return fmt.Sprintf(`<a href="pubkey:%s">%s</a>`, pubkey, html.EscapeString(names[pubkey]))
+	}
+	targets := func() string {
+		linked := make([]string, 0, 1)
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "p" && nostr.IsValidPublicKey(tag[1]) {
+				linked = append(linked, link(tag[1]))
+			}
+		}
+		return strings.Join(linked, ", ")
+	}
+
+	actor := link(evt.PubKey)
+	switch evt.Kind {
+	case nostr.KindSimpleGroupPutUser:
+		if tag := evt.Tags.GetFirst([]string{"p", ""}); tag != nil && len(*tag) > 2 {
+			roles := html.EscapeString(strings.Join((*tag)[2:], ", "))
+			return fmt.Sprintf("%s added %s as <b>%s</b>", actor, targets(), roles)
+		}
+		return fmt.Sprintf("%s added %s", actor, targets())
+	case nostr.KindSimpleGroupRemoveUser:
+		return fmt.Sprintf("%s removed %s", actor, targets())
+	case nostr.KindSimpleGroupEditMetadata:
+		changes := make([]string, 0, 4)
+		// the whole metadata is sent every time, so we can't tell what has actually changed
+		if tag := evt.Tags.GetFirst([]string{"name", ""}); tag != nil {
+			changes = append(changes, fmt.Sprintf("set the name to <b>%s</b>", html.EscapeString((*tag)[1])))
+		}
+		if evt.Tags.GetFirst([]string{"about"}) != nil {
+			changes = append(changes, "set the description")
+		}
+		if evt.Tags.GetFirst([]string{"picture"}) != nil {
+			changes = append(changes, "set the picture")
+		}
+		status := make([]string, 0, 2)
+		for _, name := range []string{"public", "private", "open", "closed"} {
+			if evt.Tags.GetFirst([]string{name}) != nil {
+				status = append(status, name)
+			}
+		}
+		if len(status) > 0 {
+			changes = append(changes, "made the group "+strings.Join(status, " and "))
+		}
+		if len(changes) == 0 {
+			return fmt.Sprintf("%s edited the group", actor)
+		}
+		return actor + " " + strings.Join(changes, ", ")
+	case nostr.KindSimpleGroupDeleteEvent:
+		deleted := make([]string, 0, 1)
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "e" && nostr.IsValid32ByteHex(tag[1]) {
+				deleted = append(deleted, tag[1])
+			}
+		}
+		switch len(deleted) {
+		case 0:
+			return fmt.Sprintf("%s deleted a message", actor)
+		case 1:
+			return fmt.Sprintf(`%s deleted <a href="event:%s">a message</a>`, actor, deleted[0])
+		default:
+			linked := make([]string, len(deleted))
+			for i, id := range deleted {
+				linked[i] = fmt.Sprintf(`<a href="event:%s">%d</a>`, id, i+1)
+			}
+			return fmt.Sprintf("%s deleted %d messages (%s)", actor, len(deleted), strings.Join(linked, ", "))
+		}
+	case nostr.KindSimpleGroupCreateGroup:
+		return fmt.Sprintf("%s created the group", actor)
+	case nostr.KindSimpleGroupDeleteGroup:
+		return fmt.Sprintf("%s deleted the group", actor)
+	case nostr.KindSimpleGroupCreateInvite:
+		return fmt.Sprintf("%s created an invite code", actor)
+	case nostr.KindSimpleGroupJoinRequest:
+		return fmt.Sprintf("%s asked to join", actor)
+	case nostr.KindSimpleGroupLeaveRequest:
+		return fmt.Sprintf("%s left", actor)
+	default:
+		return fmt.Sprintf("%s did something (kind %d)", actor, evt.Kind)
+	}
+}
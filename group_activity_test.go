@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDescribeActivity(t *testing.T) {
+	admin, member := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	message, other := strings.Repeat("1", 64), strings.Repeat("2", 64)
+	names := map[string]string{admin: "admin", member: "<member>"}
+
+	for _, tc := range []struct {
+		name string
+		kind int
+		tags nostr.Tags
+		want string
+	}{
+		{"added", nostr.KindSimpleGroupPutUser, nostr.Tags{{"p", member}},
+			`<a href="pubkey:` + admin + `">admin</a> added <a href="pubkey:` + member + `">&lt;member&gt;</a>`},
+		{"added with roles", nostr.KindSimpleGroupPutUser, nostr.Tags{{"p", member, "moderator"}},
+			`<a href="pubkey:` + admin + `">admin</a> added <a href="pubkey:` + member + `">&lt;member&gt;</a> as <b>moderator</b>`},
+		{"metadata", nostr.KindSimpleGroupEditMetadata, nostr.Tags{{"name", "<b>"}, {"about", "x"}, {"picture", "y"}, {"public"}, {"open"}},
+			`<a href="pubkey:` + admin + `">admin</a> set the name to <b>&lt;b&gt;</b>, set the description, set the picture, made the group public and open`},
+		{"empty metadata", nostr.KindSimpleGroupEditMetadata, nil,
+			`<a href="pubkey:` + admin + `">admin</a> edited the group`},
+		{"deleted a message", nostr.KindSimpleGroupDeleteEvent, nostr.Tags{{"e", message}},
+			`<a href="pubkey:` + admin + `">admin</a> deleted <a href="event:` + message + `">a message</a>`},
+		{"deleted messages", nostr.KindSimpleGroupDeleteEvent, nostr.Tags{{"e", message}, {"e", other}},
+			`<a href="pubkey:` + admin + `">admin</a> deleted 2 messages (<a href="event:` + message + `">1</a>, <a href="event:` + other + `">2</a>)`},
+		{"invalid id isn't linked", nostr.KindSimpleGroupDeleteEvent, nostr.Tags{{"e", `"><b>`}},
+			`<a href="pubkey:` + admin + `">admin</a> deleted a message`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evt := &nostr.Event{PubKey: admin, Kind: tc.kind, Tags: tc.tags}
+			if got := describeActivity(evt, names); got != tc.want {
+				t.Errorf("describeActivity\n got %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
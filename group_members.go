@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"fiatjaf.com/nostr-gtk/components/profile"
+	"fiatjaf.com/shiitake/global"
+	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
+	"github.com/diamondburned/gotkit/app"
+	"github.com/diamondburned/gotkit/app/locale"
+	"github.com/diamondburned/gotkit/gtkutil"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// newRoleBadge displays the name of a role, with its description on hover.
+func newRoleBadge(role *nip29.Role) *gtk.Label {
+	badge := gtk.NewLabel(role.Name)
+	badge.AddCSSClass("role-badge")
+	badge.AddCSSClass("text-xs")
+	badge.AddCSSClass("ml-1")
+	badge.SetVAlign(gtk.AlignCenter)
+	if role.Description != "" {
+		badge.SetTooltipText(role.Description)
+	}
+	return badge
+}
+
+// newMembersBox displays all the members of the group, either all together or in sections by role.
+func (v *GroupView) newMembersBox(byRole bool) gtk.Widgetter {
+	newFlowBox := func() *gtk.FlowBox {
+		flowBox := gtk.NewFlowBox()
+		flowBox.AddCSSClass("background")
+		flowBox.SetSelectionMode(gtk.SelectionNone)
+		return flowBox
+	}
+
+	if !byRole {
+		flowBox := newFlowBox()
+		for pubkey, roles := range v.group.Members {
+			flowBox.Insert(v.newMemberWidget(pubkey, roles), -1)
+		}
+		return flowBox
+	}
+
+	box := gtk.NewBox(gtk.OrientationVertical, 0)
+
+	// members without any role go at the end
+	sections := append(v.group.RoleNames(), "")
+	for _, name := range sections {
+		flowBox := newFlowBox()
+		count := 0
+		for pubkey, roles := range v.group.Members {
+			hasRole := slices.ContainsFunc(roles, func(role *nip29.Role) bool { return role.Name == name })
+			if hasRole || (name == "" && len(roles) == 0) {
+				flowBox.Insert(v.newMemberWidget(pubkey, roles), -1)
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+
+		title := name
+		if title == "" {
+			title = "Members"
+		}
+		heading := gtk.NewLabel(title)
+		heading.AddCSSClass("title-4")
+		heading.AddCSSClass("mt-4")
+		heading.SetXAlign(0)
+		box.Append(heading)
+
+		if role := v.group.GetRoleByName(name); role.Description != "" {
+			description := gtk.NewLabel(role.Description)
+			description.AddCSSClass("dim-label")
+			description.SetXAlign(0)
+			description.SetWrap(true)
+			box.Append(description)
+		}
+
+		box.Append(flowBox)
+	}
+
+	return box
+}
+
+// newMemberWidget displays a member of the group, admins get a context menu to manage them.
+func (v *GroupView) newMemberWidget(pubkey string, roles []*nip29.Role) gtk.Widgetter {
+	badges := gtk.NewBox(gtk.OrientationHorizontal, 0)
+	for _, role := range roles {
+		badges.Append(newRoleBadge(role))
+	}
+
+	p := profile.New(v.ctx, global.System, pubkey, badges)
+	p.AddCSSClass("px-4")
+	p.AddCSSClass("py-2")
+
+	if v.group.IsAdmin(v.me.PubKey) {
+		gtkutil.BindActionMap(p, map[string]func(){
+			"member.edit-roles": func() { v.showRolesDialog(pubkey) },
+			"member.remove":     func() { v.removeMember(pubkey) },
+		})
+		gtkutil.BindPopoverMenuCustom(p, gtk.PosBottom, []gtkutil.PopoverMenuItem{
+			gtkutil.MenuItem("Edit _Roles", "member.edit-roles"),
+			gtkutil.MenuItem("_Remove from Group", "member.remove"),
+		})
+	}
+
+	return p
+}
+
+// showRolesDialog lets an admin pick the roles a member will have, which can also be new roles.
+func (v *GroupView) showRolesDialog(pubkey string) {
+	current := v.group.Members[pubkey]
+
+	checks := make(map[string]*gtk.CheckButton)
+	fields := gtk.NewBox(gtk.OrientationVertical, 6)
+	for _, name := range v.group.RoleNames() {
+		check := gtk.NewCheckButtonWithLabel(name)
+		check.SetActive(slices.ContainsFunc(current, func(role *nip29.Role) bool { return role.Name == name }))
+		checks[name] = check
+		fields.Append(check)
+	}
+
+	newRole := gtk.NewEntry()
+	newRole.SetPlaceholderText("New role")
+	fields.Append(newRole)
+
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window,
+		locale.Get("Edit Roles"),
+		locale.Get("Choose the roles this member will have in the group."))
+	dialog.SetExtraChild(fields)
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("save", locale.Get("_Save"))
+	dialog.SetResponseAppearance("save", adw.ResponseSuggested)
+	dialog.SetDefaultResponse("save")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		if response != "save" {
+			return
+		}
+
+		roles := make([]string, 0, len(checks)+1)
+		for name, check := range checks {
+			if check.Active() {
+				roles = append(roles, name)
+			}
+		}
+		if name := strings.TrimSpace(newRole.Text()); name != "" && !slices.Contains(roles, name) {
+			roles = append(roles, name)
+		}
+		slices.Sort(roles)
+
+		v.moderate(func() error { return v.group.PutUser(v.ctx, pubkey, roles...) }, "Roles updated")
+	})
+	dialog.Show()
+
+	global.RequestUser(v.ctx, pubkey, func(user global.User) {
+		glib.IdleAdd(func() {
+			dialog.SetBody(locale.Sprintf("Choose the roles %s will have in the group.", user.ShortName()))
+		})
+	})
+}
+
+func (v *GroupView) removeMember(pubkey string) {
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window,
+		locale.Get("Remove Member"),
+		locale.Get("Are you sure you want to remove this member from the group?"))
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("remove", locale.Get("_Remove"))
+	dialog.SetResponseAppearance("remove", adw.ResponseDestructive)
+	dialog.SetDefaultResponse("cancel")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		switch response {
+		case "remove":
+			v.moderate(func() error { return v.group.RemoveUser(v.ctx, pubkey, "") }, "Member removed")
+		}
+	})
+	dialog.Show()
+
+	global.RequestUser(v.ctx, pubkey, func(user global.User) {
+		glib.IdleAdd(func() {
+			dialog.SetBody(locale.Sprintf("Are you sure you want to remove %s from the group?", user.ShortName()))
+		})
+	})
+}
+
+// showAddMemberDialog lets an admin search for someone by name, npub or nip05 address and add them.
+func (v *GroupView) showAddMemberDialog() {
+	search := gtk.NewSearchEntry()
+	search.SetObjectProperty("placeholder-text", "Name, npub or NIP-05 address")
+
+	results := gtk.NewListBox()
+	results.SetSelectionMode(gtk.SelectionSingle)
+	results.AddCSSClass("boxed-list")
+
+	resultsWrap := gtk.NewScrolledWindow()
+	resultsWrap.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+	resultsWrap.SetMinContentHeight(240)
+	resultsWrap.SetChild(results)
+
+	fields := gtk.NewBox(gtk.OrientationVertical, 6)
+	fields.Append(search)
+	fields.Append(resultsWrap)
+
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window, locale.Get("Add Member"), "")
+	dialog.SetExtraChild(fields)
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("add", locale.Get("_Add"))
+	dialog.SetResponseAppearance("add", adw.ResponseSuggested)
+	dialog.SetResponseEnabled("add", false)
+	dialog.SetCloseResponse("cancel")
+
+	var found []global.User
+	results.ConnectRowSelected(func(row *gtk.ListBoxRow) {
+		dialog.SetResponseEnabled("add", row != nil)
+	})
+
+	// only the latest search matters, the previous one is canceled whenever the query changes
+	cancelSearch := func() {}
+	search.ConnectSearchChanged(func() {
+		cancelSearch()
+
+		query := strings.TrimSpace(search.Text())
+		for row := results.RowAtIndex(0); row != nil; row = results.RowAtIndex(0) {
+			results.Remove(row)
+		}
+		found = nil
+		if query == "" {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(v.ctx, time.Second*10)
+		cancelSearch = cancel
+		go func() {
+			users := global.SearchUsers(ctx, query)
+			if ctx.Err() != nil {
+				return
+			}
+
+			glib.IdleAdd(func() {
+				if ctx.Err() != nil {
+					return
+				}
+				found = users
+				for _, user := range users {
+					hint := gtk.NewLabel(user.NIP05)
+					if user.NIP05 == "" {
+						hint.SetLabel(user.Npub())
+					}
+					hint.SetEllipsize(pango.EllipsizeMiddle)
+					hint.SetXAlign(0)
+
+					p := profile.New(v.ctx, global.System, user.PubKey, hint)
+					p.AddCSSClass("p-2")
+					results.Append(p)
+				}
+			})
+		}()
+	})
+
+	dialog.ConnectResponse(func(response string) {
+		cancelSearch()
+		if response != "add" {
+			return
+		}
+
+		row := results.SelectedRow()
+		if row == nil || row.Index() >= len(found) {
+			return
+		}
+		pubkey := found[row.Index()].PubKey
+		v.moderate(func() error { return v.group.PutUser(v.ctx, pubkey) }, "Member added")
+	})
+	dialog.Show()
+}
+
+// moderate runs an action that publishes a moderation event and tells the user how it went.
+func (v *GroupView) moderate(publish func() error, success string) {
+	go func() {
+		err := publish()
+
+		glib.IdleAdd(func() {
+			if err != nil {
+				slog.Warn(err.Error())
+				win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+				return
+			}
+			win.Toast(success)
+		})
+	}()
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"fiatjaf.com/shiitake/global"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotkit/app/locale"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// workBar is displayed above the composer while we do the proof-of-work the relay requires
+// for the messages we're sending, and lets the user give up on them.
+type workBar struct {
+	*gtk.Revealer
+	label    *gtk.Label
+	progress *gtk.ProgressBar
+
+	nextID  uint64
+	working map[uint64]context.CancelFunc // messages being worked on
+}
+
+func newWorkBar() *workBar {
+	w := &workBar{
+		working: make(map[uint64]context.CancelFunc),
+	}
+
+	w.label = gtk.NewLabel("")
+	w.label.SetXAlign(0)
+	w.label.SetHExpand(true)
+
+	w.progress = gtk.NewProgressBar()
+	w.progress.SetPulseStep(0.1)
+	w.progress.SetVAlign(gtk.AlignCenter)
+	w.progress.SetHExpand(true)
+
+	cancel := gtk.NewButtonWithLabel("Cancel")
+	cancel.ConnectClicked(func() {
+		for _, cancel := range w.working {
+			cancel()
+		}
+	})
+
+	box := gtk.NewBox(gtk.OrientationHorizontal, 12)
+	box.AddCSSClass("px-4")
+	box.AddCSSClass("py-2")
+	box.Append(w.label)
+	box.Append(w.progress)
+	box.Append(cancel)
+
+	w.Revealer = gtk.NewRevealer()
+	w.Revealer.SetChild(box)
+	w.Revealer.SetRevealChild(false)
+
+	return w
+}
+
+// start is called when the work for a message starts, it returns a function to call when it's over.
+func (w *workBar) start(difficulty int, cancel context.CancelFunc) (done func()) {
+	id := w.nextID
+	w.nextID++
+	w.working[id] = cancel
+
+	w.label.SetText(locale.Sprintf("Doing the proof-of-work this relay requires (difficulty %d)...", difficulty))
+	if len(w.working) == 1 {
+		w.Revealer.SetRevealChild(true)
+		glib.TimeoutAdd(100, func() bool {
+			w.progress.Pulse()
+			return len(w.working) > 0
+		})
+	}
+
+	return func() {
+		delete(w.working, id)
+		if len(w.working) == 0 {
+			w.Revealer.SetRevealChild(false)
+		}
+	}
+}
+
+type deliveryState int
+
+const (
+	deliveryPending deliveryState = iota // waiting for the relay to say it's OK
+	deliveryQueued                       // in the outbox, waiting for the relay to be reachable
+	deliverySent
+	deliveryFailed
+)
+
+// delivery is how a message we've sent is doing.
+type delivery struct {
+	state deliveryState
+	err   error
+}
+
+// sendMessage makes and signs a chat message in the background, then displays it immediately while
+// it is delivered. if it needs proof-of-work the progress is displayed and if that is canceled or
+// fails the text goes back to the composer.
+func (v *GroupView) sendMessage(text string, replyingTo string) {
+	ctx, cancel := context.WithCancel(v.ctx)
+	var workDone func() // only touched from the main thread
+	ctx = global.WithWorkStarted(ctx, func(difficulty int) {
+		glib.IdleAdd(func() {
+			if workDone == nil {
+				workDone = v.chat.work.start(difficulty, cancel)
+			}
+		})
+	})
+
+	go func() {
+		evt, err := v.group.PrepareChatMessage(ctx, text, replyingTo)
+		cancel()
+
+		glib.IdleAdd(func() {
+			if workDone != nil {
+				workDone()
+			}
+
+			if err != nil {
+				// don't lose what was written, nor what it was replying to
+				if start, end := v.chat.composer.Input.Buffer.Bounds(); v.chat.composer.Input.Buffer.Text(start, end, false) == "" {
+					v.chat.composer.Input.Buffer.SetText(text)
+					if parent, ok := v.chat.messages[replyingTo]; ok && v.chat.replyingTo == "" {
+						v.replyToEvent(parent)
+					}
+				}
+				if !errors.Is(err, context.Canceled) {
+					slog.Warn(err.Error())
+					win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+				}
+				return
+			}
+
+			v.chat.delivery[evt.ID] = &delivery{state: deliveryPending}
+			v.appendMessage(evt)
+			v.deliver(evt)
+		})
+	}()
+}
+
+// deliver publishes a message that is already displayed, updating its state when the relay answers.
+func (v *GroupView) deliver(evt *nostr.Event) {
+	v.setDelivery(evt.ID, &delivery{state: deliveryPending})
+
+	go func() {
+		published, err := v.group.Deliver(v.ctx, evt)
+
+		glib.IdleAdd(func() {
+			v.handleDelivery(global.Delivery{ID: evt.ID, Event: published, Err: err})
+		})
+	}()
+}
+
+func (v *GroupView) handleDelivery(d global.Delivery) {
+	state := &delivery{state: deliverySent}
+	if errors.Is(d.Err, global.ErrQueued) {
+		state = &delivery{state: deliveryQueued}
+	} else if d.Err != nil {
+		slog.Warn(d.Err.Error())
+		state = &delivery{state: deliveryFailed, err: d.Err}
+	}
+
+	if d.Event.ID != d.ID {
+		// the relay wanted more proof-of-work, so this is a different event now
+		if pos := v.messagePosition(d.ID); pos != -1 {
+			delete(v.chat.messages, d.ID)
+			delete(v.chat.delivery, d.ID)
+			if _, exists := v.chat.messages[d.Event.ID]; exists {
+				// the relay has already sent it back to us
+				v.chat.model.Splice(pos, 1)
+			} else {
+				v.trackMessage(d.Event)
+				v.chat.model.Splice(pos, 1, d.Event)
+			}
+		}
+	}
+
+	v.setDelivery(d.Event.ID, state)
+}
+
+func (v *GroupView) setDelivery(id string, state *delivery) {
+	v.chat.delivery[id] = state
+	v.rebindMessage(v.messagePosition(id))
+}
+
+// RetrySending tries to deliver again a message that has failed.
+func (v *GroupView) RetrySending(id string) {
+	if evt, ok := v.chat.messages[id]; ok {
+		v.deliver(evt)
+	}
+}
+
+// Discard gives up on a message that has failed or that is waiting in the outbox.
+func (v *GroupView) Discard(id string) {
+	v.group.Discard(id)
+	delete(v.chat.delivery, id)
+	v.deleteMessage(id)
+}
+
+// saveDraft takes what is in the composer (and what it is replying to) to be written to disk in a moment.
+func (v *GroupView) saveDraft() {
+	if v.chat.composer == nil {
+		return
+	}
+
+	start, end := v.chat.composer.Input.Buffer.Bounds()
+	draft := global.Draft{
+		Text:    v.chat.composer.Input.Buffer.Text(start, end, false),
+		ReplyTo: v.chat.replyingTo,
+	}
+	if draft.Text == "" {
+		// replying to something without having written anything isn't worth keeping
+		draft.ReplyTo = ""
+	}
+
+	win.main.Sidebar.markDraft(v.group.Address, !draft.IsEmpty())
+	v.chat.draftSaver(func() { global.SetDraft(v.group.Address, draft) })
+}
+
+// restoreDraft puts back in the composer what was written there before the app was closed.
+func (v *GroupView) restoreDraft() {
+	draft := global.GetDraft(v.group.Address)
+	if draft.IsEmpty() {
+		return
+	}
+
+	v.chat.composer.Input.Buffer.SetText(draft.Text)
+
+	if draft.ReplyTo == "" {
+		return
+	}
+	if event, ok := v.chat.messages[draft.ReplyTo]; ok {
+		v.replyToEvent(event)
+		return
+	}
+
+	// the message may not have been loaded yet, or it may be too old for that
+	go func() {
+		event, err := v.group.GetMessage(v.ctx, draft.ReplyTo)
+		if err != nil {
+			slog.Warn("failed to get the message the draft was replying to", "id", draft.ReplyTo, "err", err)
+			return
+		}
+
+		glib.IdleAdd(func() {
+			// unless the user has started replying to something else meanwhile
+			if v.chat.replyingTo == "" {
+				v.replyToEvent(event)
+			}
+		})
+	}()
+}
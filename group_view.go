@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"html"
 	"log/slog"
+	"slices"
 	"strings"
-	"sync"
+	"time"
 
 	"fiatjaf.com/nostr-gtk/components/avatar"
 	"fiatjaf.com/nostr-gtk/components/composer"
@@ -12,11 +16,15 @@ import (
 	"fiatjaf.com/shiitake/components/autoscroll"
 	"fiatjaf.com/shiitake/global"
 	"fiatjaf.com/shiitake/utils"
-	"github.com/diamondburned/arikawa/v3/discord"
+	"github.com/bep/debounce"
 	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/core/gioutil"
 	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotkit/app"
+	"github.com/diamondburned/gotkit/app/locale"
 	"github.com/diamondburned/gotkit/gtkutil"
+	"github.com/dustin/go-humanize"
 	"github.com/nbd-wtf/go-nostr"
 	"golang.org/x/exp/maps"
 )
@@ -28,16 +36,45 @@ type GroupView struct {
 	me      *global.Me
 	group   *global.Group
 	destroy context.CancelFunc // call this when the group is destroyed so subscriptions will be closed
+	pages   *adw.ViewStack     // the group details, chat, activity and so on
 
 	chat struct {
 		scroll      *autoscroll.Window
-		list        *gtk.ListBox
+		view        *gtk.ListView
+		model       *gioutil.ListModel[*nostr.Event]
+		widgets     map[uintptr]*Message // message widgets created by the list factory, by list item
+		loadMore    *gtk.Button
 		bottomStack *gtk.Stack
 		composer    *composer.ComposerView
-		replyingTo  *gtk.ListBoxRow
+		work        *workBar
+		replyingTo  string
+		draftSaver  func(func()) // debounces writing the draft to disk
+
+		messages      map[string]*nostr.Event // events currently in the model, by id
+		parents       map[string]*nostr.Event // messages replied to that we had to fetch, nil if they couldn't be
+		oldest        nostr.Timestamp         // created_at of the oldest message we have displayed
+		noMoreHistory bool                    // set when the relay has nothing older to give us
+
+		delivery map[string]*delivery // how the messages we've sent are doing, by message id
+	}
+
+	requests struct {
+		page *adw.ViewStackPage
+		list *gtk.ListBox
+	}
+
+	activity struct {
+		list   *gtk.ListBox
+		events map[uintptr]*nostr.Event // the event displayed in each row, by row
+		seen   map[string]struct{}      // ids of the events already in the list
 	}
 }
 
+// how many messages we ask the relay for each time "Show More" is clicked
+const historyPageSize = 100
+
+var messageListModel = gioutil.NewListModelType[*nostr.Event]()
+
 func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 	me := global.GetMe(ctx)
 	ctx, cancel := context.WithCancel(ctx)
@@ -49,8 +86,14 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		group:       group,
 		destroy:     cancel,
 	}
+	v.chat.messages = make(map[string]*nostr.Event, 500)
+	v.chat.parents = make(map[string]*nostr.Event)
+	v.chat.widgets = make(map[uintptr]*Message, 50)
+	v.chat.delivery = make(map[string]*delivery)
+	v.chat.draftSaver = debounce.New(500 * time.Millisecond)
 
 	viewStack := adw.NewViewStack()
+	v.pages = viewStack
 
 	// this thing will display the names of each stack item automatically at the top
 	// (as long as we add them with AddTitled() and provide a title)
@@ -65,6 +108,24 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 	headerBar.SetShowStartTitleButtons(false)
 	headerBar.SetShowTitle(true)
 
+	// this is only revealed while we're not connected to the group relay
+	disconnectedBanner := adw.NewBanner("Disconnected from " + trimProtocol(group.Address.Relay) + ", reconnecting...")
+	disconnectedBanner.SetRevealed(false)
+
+	// this is revealed when we can't be sure the group details came from the relay
+	metadataBanner := adw.NewBanner("")
+	metadataBanner.AddCSSClass("warning")
+	metadataBanner.SetRevealed(false)
+
+	group.OnUpdated(func() {
+		glib.IdleAdd(func() {
+			disconnectedBanner.SetRevealed(!group.IsConnected())
+			warning := group.MetadataWarning()
+			metadataBanner.SetTitle(warning)
+			metadataBanner.SetRevealed(warning != "")
+		})
+	})
+
 	// group info
 	{
 		groupInfo := gtk.NewBox(gtk.OrientationVertical, 0)
@@ -90,62 +151,94 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		groupInfo.Append(id)
 
 		about := gtk.NewLabel(group.About)
-		about.AddCSSClass("mb-4")
+		about.AddCSSClass("mb-2")
 		groupInfo.Append(about)
 
+		status := gtk.NewLabel(groupStatus(group))
+		status.AddCSSClass("dim-label")
+		status.AddCSSClass("mb-4")
+		groupInfo.Append(status)
+
 		button := gtk.NewButtonWithLabel("Join/Leave")
 		button.AddCSSClass("text-2xl")
 		button.AddCSSClass("mx-24")
 		button.ConnectClicked(func() {
 			switch button.Label() {
 			case "Join":
-				button.SetLabel("Joining...")
+				revert := utils.ButtonLoading(button, "Joining...")
+				v.join("", revert)
+			case "Cancel Request":
+				// the label is updated once the request isn't pending anymore, like when leaving
+				button.SetLabel("Canceling...")
 				button.SetSensitive(false)
-				glib.IdleAddPriority(glib.PriorityLow, func() {
-					if err := global.JoinGroup(ctx, group.Address); err != nil {
-						win.ErrorToast(err.Error())
-					}
-					button.SetSensitive(true)
-				})
+				v.cancelJoinRequest(func() { button.SetSensitive(true) })
 			case "Leave":
 				button.SetLabel("Leaving...")
 				button.SetSensitive(false)
-				glib.IdleAddPriority(glib.PriorityLow, func() {
-					if err := global.LeaveGroup(ctx, group.Address); err != nil {
-						win.ErrorToast(err.Error())
-					}
-					button.SetSensitive(true)
-				})
+				go func() {
+					err := global.LeaveGroup(ctx, group.Address)
+					glib.IdleAdd(func() {
+						if err != nil {
+							slog.Warn(err.Error())
+							win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+						}
+						button.SetSensitive(true)
+					})
+				}()
 			}
 		})
 		groupInfo.Append(button)
 
-		membersBox := gtk.NewFlowBox()
-		membersBox.AddCSSClass("mt-6")
-		membersBox.AddCSSClass("background")
-		membersBox.SetDirection(gtk.TextDirection(gtk.OrientationHorizontal))
+		editDetails := gtk.NewButtonWithLabel("Edit Details")
+		editDetails.AddCSSClass("mx-24")
+		editDetails.AddCSSClass("mt-2")
+		editDetails.SetVisible(false)
+		editDetails.ConnectClicked(v.showEditDetailsDialog)
+		groupInfo.Append(editDetails)
+
+		createInvite := gtk.NewButtonWithLabel("Create Invite Link")
+		createInvite.AddCSSClass("mx-24")
+		createInvite.AddCSSClass("mt-2")
+		createInvite.SetVisible(false)
+		createInvite.ConnectClicked(v.showCreateInviteDialog)
+		groupInfo.Append(createInvite)
+
+		addMember := gtk.NewButtonWithLabel("Add Member")
+		addMember.AddCSSClass("mx-24")
+		addMember.AddCSSClass("mt-2")
+		addMember.SetVisible(false)
+		addMember.ConnectClicked(v.showAddMemberDialog)
+		groupInfo.Append(addMember)
+
+		deleteGroup := gtk.NewButtonWithLabel("Delete Group")
+		deleteGroup.AddCSSClass("destructive-action")
+		deleteGroup.AddCSSClass("mx-24")
+		deleteGroup.AddCSSClass("mt-2")
+		deleteGroup.SetVisible(false)
+		deleteGroup.ConnectClicked(v.deleteGroup)
+		groupInfo.Append(deleteGroup)
+
+		authPolicy := newAuthPolicySelector(group.Address.Relay)
+		authPolicy.AddCSSClass("mx-24")
+		authPolicy.AddCSSClass("mt-6")
+		groupInfo.Append(authPolicy)
+
+		groupByRole := gtk.NewCheckButtonWithLabel("Group by role")
+		groupByRole.AddCSSClass("mt-6")
+		groupByRole.SetHAlign(gtk.AlignEnd)
+		groupInfo.Append(groupByRole)
+
+		membersBox := gtk.NewBox(gtk.OrientationVertical, 0)
 		groupInfo.Append(membersBox)
 
-		fillingLock := sync.Mutex{}
 		fillInMembers := func() {
-			fillingLock.Lock()
-			defer fillingLock.Unlock()
-
-			glib.IdleAdd(func() {
-				for pubkey, role := range group.Members {
-					roleName := ""
-					if role != nil {
-						// taking the first role
-						roleName = role[0].Name
-					}
-					p := profile.New(ctx, global.System, pubkey, gtk.NewLabel(roleName))
-					p.AddCSSClass("px-4")
-					p.AddCSSClass("py-2")
-					membersBox.Insert(p, -1)
-				}
-			})
+			for child := membersBox.FirstChild(); child != nil; child = membersBox.FirstChild() {
+				membersBox.Remove(child)
+			}
+			membersBox.Append(v.newMembersBox(groupByRole.Active()))
 		}
-		go fillInMembers()
+		fillInMembers()
+		groupByRole.ConnectToggled(fillInMembers)
 
 		groupInfoWrap := gtk.NewScrolledWindow()
 		groupInfoWrap.SetVExpand(true)
@@ -163,25 +256,27 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 				name.SetLabel(group.Name)
 				id.SetLabel(group.Address.String())
 				about.SetLabel(group.About)
+				status.SetLabel(groupStatus(group))
+				editDetails.SetVisible(group.IsAdmin(v.me.PubKey))
+				createInvite.SetVisible(group.IsAdmin(v.me.PubKey))
+				deleteGroup.SetVisible(group.IsAdmin(v.me.PubKey))
+				addMember.SetVisible(group.IsAdmin(v.me.PubKey))
+				fillInMembers()
 			})
-
-			fillingLock.Lock()
-			glib.IdleAdd(func() {
-				for fbc := range children[*gtk.FlowBox, *gtk.FlowBoxChild](membersBox) {
-					membersBox.Remove(fbc)
-				}
-			})
-			fillingLock.Unlock()
-			fillInMembers()
 		})
 
 		// display either "join" or "leave" at the bottom depending on group membership status
 		setJoinOrLeave := func() {
 			glib.IdleAdd(func() {
+				button.SetSensitive(true)
 				if v.me.InGroup(v.group.Address) {
 					button.SetLabel("Leave")
 					button.AddCSSClass("destructive-action")
 					button.RemoveCSSClass("suggested-action")
+				} else if v.me.IsJoinPending(v.group.Address) {
+					button.SetLabel("Cancel Request")
+					button.RemoveCSSClass("suggested-action")
+					button.RemoveCSSClass("destructive-action")
 				} else {
 					button.SetLabel("Join")
 					button.AddCSSClass("suggested-action")
@@ -206,16 +301,73 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		joinButton.SetTooltipText("Join Group")
 		joinButton.ConnectClicked(func() {
 			revert := utils.ButtonLoading(joinButton, "Joining...")
-			glib.IdleAddPriority(glib.PriorityLow, func() {
-				if err := global.JoinGroup(ctx, group.Address); err != nil {
-					win.ErrorToast(err.Error())
-				}
-				revert()
-			})
+			v.join("", revert)
+		})
+
+		pendingLabel := gtk.NewLabel("Waiting for an admin to approve your request to join this group")
+		pendingLabel.AddCSSClass("dim-label")
+		pendingLabel.SetWrap(true)
+		pendingLabel.SetHExpand(true)
+
+		cancelRequest := gtk.NewButtonWithLabel("Cancel Request")
+		cancelRequest.SetVAlign(gtk.AlignCenter)
+		cancelRequest.ConnectClicked(func() {
+			revert := utils.ButtonLoading(cancelRequest, "Canceling...")
+			v.cancelJoinRequest(revert)
+		})
+
+		pending := gtk.NewBox(gtk.OrientationHorizontal, 12)
+		pending.AddCSSClass("p-8")
+		pending.Append(pendingLabel)
+		pending.Append(cancelRequest)
+
+		// message widgets are only created for the rows that are visible and then recycled as
+		// the user scrolls, so we must never keep per-message state in them, only in the model
+		factory := gtk.NewSignalListItemFactory()
+		factory.ConnectSetup(func(item *gtk.ListItem) {
+			item.SetActivatable(false)
+			item.SetSelectable(false)
+
+			cmessage := NewMessage(v.ctx, v)
+			v.chat.widgets[item.Native()] = cmessage
+			item.SetChild(cmessage)
+		})
+		factory.ConnectBind(func(item *gtk.ListItem) {
+			cmessage, ok := v.chat.widgets[item.Native()]
+			if !ok {
+				return
+			}
+
+			event := messageListModel.ObjectValue(item.Item())
+			pos := int(item.Position())
+			authorIdem := pos > 0 && v.chat.model.At(pos-1).PubKey == event.PubKey
+			cmessage.Bind(event, event.PubKey == v.me.PubKey, authorIdem)
+		})
+		factory.ConnectUnbind(func(item *gtk.ListItem) {
+			if cmessage, ok := v.chat.widgets[item.Native()]; ok {
+				cmessage.Unbind()
+			}
+		})
+		factory.ConnectTeardown(func(item *gtk.ListItem) {
+			delete(v.chat.widgets, item.Native())
 		})
 
-		v.chat.list = gtk.NewListBox()
-		v.chat.list.SetSelectionMode(gtk.SelectionNone)
+		v.chat.model = messageListModel.New()
+		v.chat.view = gtk.NewListView(gtk.NewNoSelection(v.chat.model), &factory.ListItemFactory)
+		v.chat.view.AddCSSClass("background")
+		v.chat.view.SetVAlign(gtk.AlignEnd)
+
+		// messages are displayed again when formatting is turned on or off
+		markdown := renderMarkdown.Value()
+		renderMarkdown.SubscribeWidget(v.chat.view, func() {
+			if markdown == renderMarkdown.Value() {
+				return
+			}
+			markdown = renderMarkdown.Value()
+			for i := range v.chat.model.Len() {
+				v.rebindMessage(i)
+			}
+		})
 
 		loadMore := gtk.NewButton()
 		loadMore.SetLabel("Show More")
@@ -223,22 +375,30 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		loadMore.SetSensitive(true)
 		loadMore.ConnectClicked(v.loadMore)
 		loadMore.Hide()
-
-		clampBox := gtk.NewBox(gtk.OrientationVertical, 0)
-		clampBox.SetHExpand(true)
-		clampBox.SetVExpand(true)
-		clampBox.SetVAlign(gtk.AlignEnd)
-		clampBox.Append(loadMore)
-		clampBox.Append(v.chat.list)
+		v.chat.loadMore = loadMore
 
 		v.chat.scroll = autoscroll.NewWindow()
 		v.chat.scroll.SetVExpand(true)
 		v.chat.scroll.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
 		v.chat.scroll.SetPropagateNaturalWidth(true)
 		v.chat.scroll.SetPropagateNaturalHeight(true)
-		v.chat.scroll.SetChild(clampBox)
+		v.chat.scroll.SetChild(v.chat.view)
+
+		// "Show More" sits above the list and only shows up once the user has scrolled all the way up
+		v.chat.scroll.ConnectEdgeReached(func(pos gtk.PositionType) {
+			if pos == gtk.PosTop && !v.chat.noMoreHistory {
+				loadMore.Show()
+			}
+		})
 
 		scrollAdjustment := v.chat.scroll.ScrolledWindow.VAdjustment()
+
+		// when the messages fit without scrolling no edge is ever reached, so it must show up anyway
+		scrollAdjustment.ConnectChanged(func() {
+			if scrollAdjustment.Upper() <= scrollAdjustment.PageSize() && !v.chat.noMoreHistory {
+				loadMore.Show()
+			}
+		})
 		scrollAdjustment.ConnectValueChanged(func() {
 			// Replicate adw.ToolbarView's behavior: if the user scrolls up, then
 			// show a small drop shadow at the bottom of the view. We're not using
@@ -251,39 +411,23 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 			} else {
 				v.chat.scroll.ScrolledWindow.RemoveCSSClass("undershoot-bottom")
 			}
-		})
-
-		vp := v.chat.scroll.Viewport()
-		vp.SetScrollToFocus(true)
-
-		lastAppendedAuthor := ""
-		appendMessage := func(event *nostr.Event) {
-			id := event.ID
-
-			authorIdem := false
-			if event.PubKey == lastAppendedAuthor {
-				authorIdem = true
-			} else {
-				lastAppendedAuthor = event.PubKey
+			if value > 0 {
+				loadMore.Hide()
 			}
-
-			cmessage := NewMessage(v.ctx, event, event.PubKey == me.PubKey, authorIdem)
-			row := gtk.NewListBoxRow()
-			row.AddCSSClass("background")
-			row.SetName(id)
-			row.SetChild(cmessage)
-
-			v.chat.list.Insert(row, -1)
-			v.chat.list.SetFocusChild(row)
-		}
+		})
 
 		v.chat.bottomStack = gtk.NewStack()
 		v.chat.bottomStack.AddNamed(joinButton, "join")
+		v.chat.bottomStack.AddNamed(pending, "pending")
 		v.chat.bottomStack.AddNamed(gtk.NewBox(gtk.OrientationHorizontal, 0), "nothing")
 		v.chat.bottomStack.SetVisibleChildName("nothing")
 
+		v.chat.work = newWorkBar()
+
 		chatView := gtk.NewBox(gtk.OrientationVertical, 0)
+		chatView.Append(loadMore)
 		chatView.Append(v.chat.scroll)
+		chatView.Append(v.chat.work)
 		chatView.Append(v.chat.bottomStack)
 
 		viewStack.AddTitled(chatView, "chat", "Chat")
@@ -291,39 +435,59 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		v.ToolbarView.SetHExpand(true)
 		v.ToolbarView.SetVExpand(true)
 		v.ToolbarView.AddTopBar(headerBar)
+		v.ToolbarView.AddTopBar(disconnectedBanner)
+		v.ToolbarView.AddTopBar(metadataBanner)
 		v.ToolbarView.SetContent(viewStack)
 
-		showingLoadMoreAlready := false
-
 		// listen for new messages
 		go func() {
 			storedMessages := <-group.StoredMessages
 
 			glib.IdleAddPriority(glib.PriorityLow, func() {
 				for i := len(storedMessages) - 1; i >= 0; i-- {
-					appendMessage(storedMessages[i])
+					v.appendMessage(storedMessages[i])
 				}
-				if v.chat.scroll.AllocatedHeight() < int(vp.VAdjustment().Upper()) {
-					showingLoadMoreAlready = true
-					loadMore.Show()
+
+				// messages that are still waiting to be sent go at the end
+				for _, evt := range group.Outbox() {
+					v.chat.delivery[evt.ID] = &delivery{state: deliveryQueued}
+					v.appendMessage(evt)
 				}
 
 				go func() {
-					for evt := range group.NewMessage {
+					for {
+						evt, ok := group.NewMessage.Next(v.ctx)
+						if !ok {
+							return
+						}
 						glib.IdleAdd(func() {
-							appendMessage(evt)
-
-							if !showingLoadMoreAlready &&
-								v.chat.scroll.AllocatedHeight() < int(vp.VAdjustment().Upper()) {
-								showingLoadMoreAlready = true
-								loadMore.Show()
-							}
+							v.appendMessage(evt)
 						})
 					}
 				}()
 			})
 		}()
 
+		// listen for messages from the outbox that were sent (or not) after reconnecting
+		go func() {
+			for {
+				d, ok := group.Delivered.Next(v.ctx)
+				if !ok {
+					return
+				}
+				glib.IdleAdd(func() {
+					v.handleDelivery(d)
+				})
+			}
+		}()
+
+		// messages are displayed again when their reactions change
+		group.OnReactionsChanged(func(id string) {
+			glib.IdleAdd(func() {
+				v.rebindMessage(v.messagePosition(id))
+			})
+		})
+
 		// display either "join" button or composer at the end depending on group membership status
 		setJoinOrCompose := func() {
 			glib.IdleAdd(func() {
@@ -335,11 +499,10 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 							System:      global.System,
 							Placeholder: "Message " + group.Address.String(),
 							OnSend: func(ctx context.Context, text string, replyingTo string) {
-								if err := v.group.SendChatMessage(ctx, text, replyingTo); err != nil {
-									slog.Warn(err.Error())
-									win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
-									return
-								}
+								v.sendMessage(text, replyingTo)
+
+								// the composer doesn't forget what it was replying to by itself
+								v.chat.composer.StopReplying()
 							},
 							OnStopEditingOrReplying: v.stopEditingOrReplying,
 							Users:                   maps.Keys(v.group.Members),
@@ -349,10 +512,15 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 							ReplyIcon:               "mail-reply-sender-symbolic",
 							UploadIcon:              "list-add-symbolic",
 						})
-						gtkutil.ForwardTyping(v.chat.list, v.chat.composer.Input)
+						gtkutil.ForwardTyping(v.chat.view, v.chat.composer.Input)
 						v.chat.bottomStack.AddNamed(v.chat.composer, "composer")
+
+						v.restoreDraft()
+						v.chat.composer.Input.Buffer.ConnectChanged(v.saveDraft)
 					}
 					v.chat.bottomStack.SetVisibleChildName("composer")
+				} else if v.me.IsJoinPending(v.group.Address) {
+					v.chat.bottomStack.SetVisibleChildName("pending")
 				} else {
 					v.chat.bottomStack.SetVisibleChildName("join")
 				}
@@ -362,6 +530,53 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 		v.me.OnListUpdated(setJoinOrCompose)
 	}
 
+	// join requests, only for admins
+	{
+		v.requests.list = gtk.NewListBox()
+		v.requests.list.SetSelectionMode(gtk.SelectionNone)
+		v.requests.list.AddCSSClass("boxed-list")
+		v.requests.list.SetVAlign(gtk.AlignStart)
+
+		empty := adw.NewStatusPage()
+		empty.SetTitle("No Pending Requests")
+		empty.SetIconName("object-select-symbolic")
+		v.requests.list.SetPlaceholder(empty)
+
+		requestsWrap := gtk.NewScrolledWindow()
+		requestsWrap.SetVExpand(true)
+		requestsWrap.SetHExpand(true)
+		requestsWrap.SetPolicy(gtk.PolicyNever, gtk.PolicyAutomatic)
+		requestsWrap.SetChild(v.requests.list)
+		requestsWrap.AddCSSClass("p-8")
+
+		v.requests.page = viewStack.AddTitled(requestsWrap, "requests", "Requests")
+		v.requests.page.SetVisible(false)
+
+		// we may become (or stop being) an admin, and requesters may have become members
+		group.OnUpdated(func() {
+			glib.IdleAdd(v.refreshRequests)
+		})
+	}
+
+	// moderation history
+	{
+		v.activity.events = make(map[uintptr]*nostr.Event)
+		v.activity.seen = make(map[string]struct{})
+		viewStack.AddTitled(v.newActivityPage(), "activity", "Activity")
+	}
+
+	// groups we haven't joined aren't in the sidebar, so we must remove ourselves
+	group.OnDeleted(func() {
+		glib.IdleAdd(func() { win.main.Groups.remove(group) })
+	})
+
+	// listen for moderation events, starting with the ones the group has seen before we were displayed
+	group.OnModeration(func(evt *nostr.Event) {
+		glib.IdleAdd(func() {
+			v.handleModeration(evt)
+		})
+	})
+
 	// forum
 	{
 		forum := gtk.NewBox(gtk.OrientationVertical, 0)
@@ -374,84 +589,556 @@ func NewGroupView(ctx context.Context, group *global.Group) *GroupView {
 	return v
 }
 
+// deleteGroup asks for confirmation, then deletes the group for everybody.
+func (v *GroupView) deleteGroup() {
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window,
+		locale.Get("Delete Group"),
+		locale.Sprintf("Are you sure you want to delete %s? All its messages will be gone for all members and this can't be undone.", v.group.Name))
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("delete", locale.Get("_Delete"))
+	dialog.SetResponseAppearance("delete", adw.ResponseDestructive)
+	dialog.SetDefaultResponse("cancel")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		if response != "delete" {
+			return
+		}
+
+		go func() {
+			err := v.group.Delete(v.ctx)
+
+			glib.IdleAdd(func() {
+				// when it works the group tells everybody it was deleted, and we're removed then
+				if err != nil {
+					slog.Warn(err.Error())
+					win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+				}
+			})
+		}()
+	})
+	dialog.Show()
+}
+
+// groupStatus describes who can read and who can join the group.
+func groupStatus(group *global.Group) string {
+	visibility := "Public"
+	if group.Private {
+		visibility = "Private"
+	}
+	access := "open"
+	if group.Closed {
+		access = "closed"
+	}
+	return visibility + " and " + access
+}
+
+// showEditDetailsDialog lets an admin change the name, picture, about and status of the group.
+func (v *GroupView) showEditDetailsDialog() {
+	form, getMetadata := newGroupMetadataForm(v.group.Group)
+
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window, locale.Get("Edit Group Details"), "")
+	dialog.SetExtraChild(form)
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("save", locale.Get("_Save"))
+	dialog.SetResponseAppearance("save", adw.ResponseSuggested)
+	dialog.SetDefaultResponse("save")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		if response != "save" {
+			return
+		}
+
+		// the details displayed are only updated when the relay sends us the new metadata
+		metadata := getMetadata()
+		v.moderate(func() error { return v.group.EditMetadata(v.ctx, metadata) }, "Group details saved")
+	})
+	dialog.Show()
+}
+
+// cancelJoinRequest stops waiting for the approval of our request to join the group.
+func (v *GroupView) cancelJoinRequest(done func()) {
+	go func() {
+		err := global.CancelJoinRequest(v.ctx, v.group.Address)
+
+		glib.IdleAdd(func() {
+			done()
+			if err != nil {
+				slog.Warn(err.Error())
+				win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+			}
+		})
+	}()
+}
+
+// join asks to join this group. closed groups, or when we have an invite code, get a dialog where
+// the code and a message to the admins can be entered. done is called when it's over in any case.
+func (v *GroupView) join(code string, done func()) {
+	send := func(code string, reason string) {
+		go func() {
+			err := global.JoinGroup(v.ctx, v.group.Address, code, reason)
+
+			glib.IdleAdd(func() {
+				done()
+
+				switch {
+				case err == nil:
+				case errors.Is(err, global.ErrJoinPending):
+					win.Toast("Join request sent, waiting for approval")
+				default:
+					slog.Warn(err.Error())
+					win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+				}
+			})
+		}()
+	}
+
+	if !v.group.Closed && code == "" {
+		send("", "")
+		return
+	}
+
+	codeEntry := gtk.NewEntry()
+	codeEntry.SetPlaceholderText("Invite code")
+	codeEntry.SetText(code)
+
+	reasonEntry := gtk.NewEntry()
+	reasonEntry.SetPlaceholderText("Message to the admins (optional)")
+
+	fields := gtk.NewBox(gtk.OrientationVertical, 6)
+	fields.Append(codeEntry)
+	fields.Append(reasonEntry)
+
+	body := locale.Sprintf("Join %s with an invite code.", v.group.Name)
+	if v.group.Closed {
+		body = locale.Sprintf("%s is closed, you need an invite code or the approval of an admin to join.", v.group.Name)
+	}
+
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window, locale.Get("Join Group"), body)
+	dialog.SetExtraChild(fields)
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("join", locale.Get("_Join"))
+	dialog.SetResponseAppearance("join", adw.ResponseSuggested)
+	dialog.SetDefaultResponse("join")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		switch response {
+		case "join":
+			send(strings.TrimSpace(codeEntry.Text()), strings.TrimSpace(reasonEntry.Text()))
+		default:
+			done()
+		}
+	})
+	dialog.Show()
+}
+
+// appendMessage adds a message to the bottom of the list, unless we have it already.
+func (v *GroupView) appendMessage(event *nostr.Event) {
+	if _, exists := v.chat.messages[event.ID]; exists || v.group.IsDeleted(event.ID) {
+		return
+	}
+
+	v.trackMessage(event)
+	v.chat.model.Append(event)
+}
+
+// trackMessage must be called for every event that is added to the model.
+func (v *GroupView) trackMessage(event *nostr.Event) {
+	v.chat.messages[event.ID] = event
+	if v.chat.oldest == 0 || event.CreatedAt < v.chat.oldest {
+		v.chat.oldest = event.CreatedAt
+	}
+}
+
+// rebindMessage makes the list bind the message at the given position again, which is needed
+// when something that affects how it is displayed changes (like the message that comes before it).
+func (v *GroupView) rebindMessage(pos int) {
+	if pos < 0 || pos >= v.chat.model.Len() {
+		return
+	}
+	v.chat.model.Splice(pos, 1, v.chat.model.At(pos))
+}
+
+// loadMore fetches the page of messages that comes before the oldest one we have
+// and prepends them to the list while keeping the scroll position where it was.
 func (v *GroupView) loadMore() {
+	until := v.chat.oldest
+	if until == 0 {
+		until = nostr.Now()
+	}
+
+	revert := utils.ButtonLoading(v.chat.loadMore, "Loading...")
+
+	go func() {
+		events, err := v.group.LoadOlderMessages(v.ctx, until, historyPageSize)
+
+		glib.IdleAdd(func() {
+			revert()
+
+			if err != nil {
+				win.ErrorToast(err.Error())
+				return
+			}
+
+			if v.prependMessages(events) == 0 {
+				// nothing older than what we have, so there is no point in showing this anymore
+				v.chat.noMoreHistory = true
+				v.chat.loadMore.Hide()
+			}
+		})
+	}()
 }
 
-// AddReaction adds an reaction to the message with the given ID.
-func (v *GroupView) AddReaction(id string, emoji discord.APIEmoji) {
-	// state := gtkcord.FromContext(v.ctx)
-	// emoji = discord.APIEmoji(gtkcord.SanitizeEmoji(string(emoji)))
-
-	// gtkutil.Async(v.ctx, func() func() {
-	// 	if err := state.React(v.chID, id, emoji); err != nil {
-	// 		err = errors.Wrap(err, "Failed to react:")
-	// 		return func() {
-	// 			toast := adw.NewToast(locale.Get("Cannot react to message"))
-	// 			toast.SetTimeout(0)
-	// 			toast.SetButtonLabel(locale.Get("Logs"))
-	// 			toast.SetActionName("")
-	// 		}
-	// 	}
-	// 	return nil
-	// })
+// prependMessages adds older messages (given newest first) to the top of the list while keeping
+// the scroll position where it was. it returns how many of these we didn't have already.
+func (v *GroupView) prependMessages(events []*nostr.Event) int {
+	// events come newest first, but the model goes from the oldest to the newest
+	fresh := make([]*nostr.Event, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		if _, exists := v.chat.messages[events[i].ID]; !exists && !v.group.IsDeleted(events[i].ID) {
+			v.trackMessage(events[i])
+			fresh = append(fresh, events[i])
+		}
+	}
+
+	if len(fresh) == 0 {
+		return 0
+	}
+
+	unlock := v.chat.scroll.LockScroll()
+	v.chat.model.Splice(0, 0, fresh...)
+
+	// the message that was at the top may now be grouped with the last one we've inserted
+	v.rebindMessage(len(fresh))
+
+	unlock()
+
+	return len(fresh)
+}
+
+// messagePosition returns the position of the message with the given id in the list, or -1.
+func (v *GroupView) messagePosition(id string) int {
+	if _, exists := v.chat.messages[id]; !exists {
+		return -1
+	}
+	for i := range v.chat.model.Len() {
+		if v.chat.model.At(i).ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ScrollToMessage scrolls the list to the message with the given id. if that message isn't
+// displayed yet we load older pages of history until we reach it.
+func (v *GroupView) ScrollToMessage(id string) {
+	if pos := v.messagePosition(id); pos != -1 {
+		v.chat.view.ActivateAction("list.scroll-to-item", glib.NewVariantUint32(uint32(pos)))
+		return
+	}
+
+	if v.group.IsDeleted(id) {
+		win.ErrorToast(locale.Get("This message was deleted."))
+		return
+	}
+
+	oldest := v.chat.oldest
+	until := oldest
+	if until == 0 {
+		until = nostr.Now()
+	}
+
+	go func() {
+		target, err := v.group.GetMessage(v.ctx, id)
+		if err != nil {
+			glib.IdleAdd(func() { win.ErrorToast(err.Error()) })
+			return
+		}
+		if oldest != 0 && target.CreatedAt >= oldest {
+			// it would be among the messages we have already, so loading older ones won't bring it
+			glib.IdleAdd(func() { win.ErrorToast(locale.Get("This message isn't in the timeline.")) })
+			return
+		}
+
+		// everything between the target and what we have must be loaded, otherwise there would be a hole
+		older := make([]*nostr.Event, 0, historyPageSize)
+		for until > target.CreatedAt {
+			events, err := v.group.LoadOlderMessages(v.ctx, until, historyPageSize)
+			if err != nil {
+				glib.IdleAdd(func() { win.ErrorToast(err.Error()) })
+				return
+			}
+			if len(events) == 0 {
+				break
+			}
+
+			older = append(older, events...)
+			if events[len(events)-1].CreatedAt == until {
+				// a page full of messages with the same timestamp, we can't go any further
+				break
+			}
+			until = events[len(events)-1].CreatedAt
+		}
+		if !slices.ContainsFunc(older, func(evt *nostr.Event) bool { return evt.ID == id }) {
+			older = append(older, target)
+		}
+		slices.SortFunc(older, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+
+		glib.IdleAdd(func() {
+			v.prependMessages(older)
+			if pos := v.messagePosition(id); pos != -1 {
+				v.chat.view.ActivateAction("list.scroll-to-item", glib.NewVariantUint32(uint32(pos)))
+			} else {
+				win.ErrorToast(locale.Get("This message isn't in the timeline."))
+			}
+		})
+	}()
+}
+
+// ToggleReaction reacts to the message with the given ID, or removes our reaction if we had
+// already reacted with the same emoji.
+func (v *GroupView) ToggleReaction(id string, emoji string) {
+	target, ok := v.chat.messages[id]
+	if !ok {
+		return
+	}
+
+	var existing *nostr.Event
+	for _, reaction := range v.group.ReactionsTo(id) {
+		if reaction.PubKey == v.me.PubKey && reaction.Content == emoji {
+			existing = reaction
+			break
+		}
+	}
+
+	go func() {
+		var err error
+		if existing != nil {
+			_, err = v.group.Unreact(v.ctx, existing)
+		} else {
+			_, err = v.group.React(v.ctx, target, emoji)
+		}
+
+		if err != nil {
+			glib.IdleAdd(func() {
+				slog.Warn(err.Error())
+				win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+			})
+		}
+	}()
 }
 
 // ReplyTo starts replying to the message with the given ID.
 func (v *GroupView) ReplyTo(id string) {
-	v.stopEditingOrReplying()
+	event, ok := v.chat.messages[id]
+	if !ok || v.chat.composer == nil {
+		return
+	}
 
-	// msg, ok := v.msgs[id]
-	// if !ok || msg.message == nil || msg.message.Event == nil {
-	// 	return
-	// }
+	v.replyToEvent(event)
+	v.chat.composer.Input.GrabFocus()
+}
+
+// replyToEvent starts replying to a message that may not be in the list.
+func (v *GroupView) replyToEvent(event *nostr.Event) {
+	id := event.ID
 
-	// v.state.row = msg.ListBoxRow
-	// v.state.replying = true
+	// this calls stopEditingOrReplying() for us
+	v.chat.composer.StartReplyingTo(event)
 
-	// v.Composer.StartReplyingTo(msg.message.Event)
+	v.chat.replyingTo = id
+	v.rebindMessage(v.messagePosition(id))
+	v.saveDraft()
+
+	global.RequestUser(v.ctx, event.PubKey, func(user global.User) {
+		glib.IdleAdd(func() {
+			if v.chat.replyingTo == id {
+				v.chat.composer.SetPlaceholderMarkup("Replying to " + html.EscapeString(user.ShortName()))
+			}
+		})
+	})
 }
 
+// stopEditingOrReplying is called by the composer whenever it stops replying, so it must
+// only clean up our side of things (calling StopReplying() from here would call us again).
 func (v *GroupView) stopEditingOrReplying() {
-	if v.chat.replyingTo != nil {
-		v.chat.composer.StopReplying()
-		v.chat.replyingTo.RemoveCSSClass("message-replying")
+	if v.chat.replyingTo != "" {
+		pos := v.messagePosition(v.chat.replyingTo)
+		v.chat.replyingTo = ""
+		v.rebindMessage(pos)
+		v.saveDraft()
+	}
+}
+
+// handleModeration applies the effects of a moderation event or of a join/leave request.
+func (v *GroupView) handleModeration(evt *nostr.Event) {
+	v.addActivity(evt)
+
+	switch evt.Kind {
+	case nostr.KindSimpleGroupDeleteEvent:
+		for _, tag := range evt.Tags {
+			if len(tag) >= 2 && tag[0] == "e" {
+				v.deleteMessage(tag[1])
+			}
+		}
+	case nostr.KindSimpleGroupJoinRequest, nostr.KindSimpleGroupLeaveRequest,
+		nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser:
+		v.refreshRequests()
 	}
 }
 
-// func (v *GroupView) Delete(id string) {
-// 	username := "?" // juuust in case
-//
-// 	row, ok := v.msgs[id]
-// 	if ok {
-// 		user := global.GetUser(v.ctx, row.message.Event.PubKey)
-// 		username = fmt.Sprintf(`<span weight="normal">%s</span>`, user.ShortName())
-// 	}
-//
-// 	window := app.GTKWindowFromContext(v.ctx)
-// 	dialog := adw.NewMessageDialog(window,
-// 		locale.Get("Delete Message"),
-// 		locale.Sprintf("Are you sure you want to delete %s's message?", username))
-// 	dialog.SetBodyUseMarkup(true)
-// 	dialog.AddResponse("cancel", locale.Get("_Cancel"))
-// 	dialog.AddResponse("delete", locale.Get("_Delete"))
-// 	dialog.SetResponseAppearance("delete", adw.ResponseDestructive)
-// 	dialog.SetDefaultResponse("cancel")
-// 	dialog.SetCloseResponse("cancel")
-// 	dialog.ConnectResponse(func(response string) {
-// 		switch response {
-// 		case "delete":
-// 			v.delete(id)
-// 		}
-// 	})
-// 	dialog.Show()
-// }
-//
-// func (v *GroupView) delete(id string) {
-// 	if msg, ok := v.msgs[id]; ok {
-// 		// Visual indicator.
-// 		msg.SetSensitive(false)
-// 	}
-// }
+// refreshRequests rebuilds the list of join requests that nobody has answered yet.
+func (v *GroupView) refreshRequests() {
+	isAdmin := v.group.IsAdmin(v.me.PubKey)
+	v.requests.page.SetVisible(isAdmin)
+	if !isAdmin {
+		return
+	}
+
+	pending := v.group.JoinRequests()
+
+	for row := v.requests.list.RowAtIndex(0); row != nil; row = v.requests.list.RowAtIndex(0) {
+		v.requests.list.Remove(row)
+	}
+	for _, request := range pending {
+		v.requests.list.Append(v.newRequestRow(request))
+	}
+
+	v.requests.page.SetBadgeNumber(uint(len(pending)))
+	v.requests.page.SetNeedsAttention(len(pending) > 0)
+}
+
+func (v *GroupView) newRequestRow(request *nostr.Event) gtk.Widgetter {
+	details := gtk.NewBox(gtk.OrientationVertical, 0)
+
+	when := gtk.NewLabel(humanize.Time(request.CreatedAt.Time()))
+	when.AddCSSClass("text-xs")
+	when.AddCSSClass("dim-label")
+	when.SetXAlign(0)
+	details.Append(when)
+
+	if request.Content != "" {
+		reason := gtk.NewLabel(request.Content)
+		reason.SetWrap(true)
+		reason.SetXAlign(0)
+		reason.SetSelectable(true)
+		details.Append(reason)
+	}
+	if code := request.Tags.GetFirst([]string{"code", ""}); code != nil {
+		codeLabel := gtk.NewLabel("Invite code: " + (*code)[1])
+		codeLabel.AddCSSClass("text-xs")
+		codeLabel.SetXAlign(0)
+		codeLabel.SetSelectable(true)
+		details.Append(codeLabel)
+	}
+
+	approve := gtk.NewButtonWithLabel("Approve")
+	approve.AddCSSClass("suggested-action")
+	approve.SetVAlign(gtk.AlignCenter)
+
+	reject := gtk.NewButtonWithLabel("Reject")
+	reject.AddCSSClass("destructive-action")
+	reject.SetVAlign(gtk.AlignCenter)
+
+	answer := func(button *gtk.Button, loadingText string, publish func() error) {
+		revert := utils.ButtonLoading(button, loadingText)
+		approve.SetSensitive(false)
+		reject.SetSensitive(false)
+
+		go func() {
+			err := publish()
+
+			glib.IdleAdd(func() {
+				revert()
+				approve.SetSensitive(true)
+				reject.SetSensitive(true)
+
+				if err != nil {
+					slog.Warn(err.Error())
+					win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+					return
+				}
+
+				// the group has applied our answer already, so the row can go away now
+				v.refreshRequests()
+			})
+		}()
+	}
+	approve.ConnectClicked(func() {
+		answer(approve, "Approving...", func() error { return v.group.PutUser(v.ctx, request.PubKey) })
+	})
+	reject.ConnectClicked(func() {
+		answer(reject, "Rejecting...", func() error {
+			return v.group.RemoveUser(v.ctx, request.PubKey, "join request rejected")
+		})
+	})
+
+	p := profile.New(v.ctx, global.System, request.PubKey, details)
+	p.SetHExpand(true)
+
+	row := gtk.NewBox(gtk.OrientationHorizontal, 8)
+	row.AddCSSClass("p-4")
+	row.Append(p)
+	row.Append(approve)
+	row.Append(reject)
+
+	return row
+}
+
+// Delete asks for confirmation and then deletes the message with the given ID.
+func (v *GroupView) Delete(id string) {
+	event, ok := v.chat.messages[id]
+	if !ok {
+		return
+	}
+
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window,
+		locale.Get("Delete Message"),
+		locale.Get("Are you sure you want to delete this message?"))
+	dialog.AddResponse("cancel", locale.Get("_Cancel"))
+	dialog.AddResponse("delete", locale.Get("_Delete"))
+	dialog.SetResponseAppearance("delete", adw.ResponseDestructive)
+	dialog.SetDefaultResponse("cancel")
+	dialog.SetCloseResponse("cancel")
+	dialog.ConnectResponse(func(response string) {
+		switch response {
+		case "delete":
+			v.delete(id)
+		}
+	})
+	dialog.Show()
+
+	global.RequestUser(v.ctx, event.PubKey, func(user global.User) {
+		if event.PubKey == v.me.PubKey {
+			return
+		}
+		glib.IdleAdd(func() {
+			dialog.SetBodyUseMarkup(true)
+			dialog.SetBody(locale.Sprintf("Are you sure you want to delete %s's message?",
+				fmt.Sprintf(`<span weight="normal">%s</span>`, html.EscapeString(user.ShortName()))))
+		})
+	})
+}
+
+func (v *GroupView) delete(id string) {
+	go func() {
+		err := v.group.DeleteMessage(v.ctx, id)
+
+		glib.IdleAdd(func() {
+			if err != nil {
+				slog.Warn(err.Error())
+				win.ErrorToast(strings.Replace(err.Error(), " msg: ", " ", 1))
+				return
+			}
+
+			// the relay will also send the deletion back to us, but there is no reason to wait for it
+			v.deleteMessage(id)
+		})
+	}()
+}
 
 // MarkRead marks the view's latest messages as read.
 func (v *GroupView) MarkRead() {
@@ -472,10 +1159,15 @@ func (v *GroupView) MarkRead() {
 }
 
 func (v *GroupView) deleteMessage(id string) {
-	for lbr := range children[*gtk.ListBox, *gtk.ListBoxRow](v.chat.list) {
-		if lbr.Name() == id {
-			v.chat.list.Remove(lbr)
-			return
-		}
+	if v.chat.replyingTo == id {
+		v.chat.composer.StopReplying()
+	}
+
+	if pos := v.messagePosition(id); pos != -1 {
+		v.chat.model.Remove(pos)
+		delete(v.chat.messages, id)
+
+		// the message that came after this one may not be grouped with the previous anymore
+		v.rebindMessage(pos)
 	}
 }
@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"strings"
 	"sync"
 
 	"fiatjaf.com/nostr-gtk/components/composer"
@@ -13,7 +11,7 @@ import (
 	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"github.com/diamondburned/gotkit/app"
-	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/diamondburned/gotkit/app/locale"
 	"github.com/nbd-wtf/go-nostr/nip29"
 )
 
@@ -112,6 +110,31 @@ func (v *GroupsController) switchTo(gad nip29.GroupAddress) {
 	v.Stack.SetVisibleChild(groupView)
 }
 
+// remove gets rid of everything we display about a group that doesn't exist anymore.
+// it is called for each place that displays the group, but only does anything the first time.
+func (v *GroupsController) remove(group *global.Group) {
+	removed := win.main.Sidebar.removeGroup(group.Address)
+
+	v.switching.Lock()
+	defer v.switching.Unlock()
+
+	if groupView, ok := v.groups[group.Address.String()]; ok {
+		removed = true
+		delete(v.groups, group.Address.String())
+
+		if v.current == groupView {
+			v.current = nil
+			win.main.OpenDiscover()
+		}
+		v.Stack.Remove(groupView)
+		groupView.destroy()
+	}
+
+	if removed {
+		win.Toast(locale.Sprintf("%s was deleted", group.Name))
+	}
+}
+
 func (v *GroupsController) currentGroup() *global.Group {
 	v.switching.Lock()
 	defer v.switching.Unlock()
@@ -121,27 +144,6 @@ func (v *GroupsController) currentGroup() *global.Group {
 	return v.current.group
 }
 
-func (v *GroupsController) updateMember(list *gtk.ListBox, pubkey string) {
-	for lbr := range children[*gtk.ListBox, *gtk.ListBoxRow](list) {
-		fmt.Println("updating member", pubkey)
-
-		// fragile: this depends on the hierarchy of components: message > rightBox > topLabel
-		label := lbr.Child().(*gtk.Box).LastChild().(*gtk.Box).FirstChild().(*gtk.Label)
-		// fragile: this depends on the string given to the tooltip
-		npub := strings.Split(strings.Split(label.TooltipMarkup(), "(")[1], ")")[0]
-		_, data, _ := nip19.Decode(npub)
-		if pubkey == data.(string) {
-			// replace avatar
-			// avatar := lbr.Child().(*gtk.Box).FirstChild()
-			// lbr.Child().(*gtk.Box).InsertBefore(newAvatar, avatar)
-			// lbr.Child().(*gtk.Box).Remove(avatar)
-
-			// replace toplabel
-			// TODO
-		}
-	}
-}
-
 // IsActive returns true if GroupsController is active and visible. This implies that the
 // window is focused.
 func (v *GroupsController) IsActive() bool {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
+	"github.com/diamondburned/gotkit/app"
+	"github.com/diamondburned/gotkit/app/locale"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+// invite links look like shiitake://join?relay=wss%3A%2F%2Fgroups.fiatjaf.com&group=abcdef&code=123456
+const inviteLinkScheme = "shiitake"
+
+func inviteLink(gad nip29.GroupAddress, code string) string {
+	query := url.Values{}
+	// the scheme stays in the link, as a relay may only be reachable with ws://
+	query.Set("relay", gad.Relay)
+	query.Set("group", gad.ID)
+	query.Set("code", code)
+	return inviteLinkScheme + "://join?" + query.Encode()
+}
+
+func parseInviteLink(link string) (gad nip29.GroupAddress, code string, ok bool) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Scheme != inviteLinkScheme || u.Host != "join" {
+		return gad, "", false
+	}
+
+	// links without the scheme in the relay are taken as wss://
+	query := u.Query()
+	gad = nip29.GroupAddress{
+		Relay: nostr.NormalizeURL(query.Get("relay")),
+		ID:    query.Get("group"),
+	}
+	return gad, query.Get("code"), gad.IsValid()
+}
+
+// OpenInviteLink opens the group an invite link points to and starts joining it with the code in the link.
+// if we're not logged in yet this is postponed until we are.
+func (w *Window) OpenInviteLink(link string) {
+	gad, code, ok := parseInviteLink(link)
+	if !ok {
+		slog.Warn("invalid invite link", "link", link)
+		w.ErrorToast("Invalid invite link")
+		return
+	}
+
+	if !w.loggedIn {
+		w.pendingInvite = link
+		return
+	}
+
+	w.main.OpenGroup(gad)
+	view, ok := w.main.Groups.groups[gad.String()]
+	if !ok {
+		slog.Warn("no view for the group in an invite link", "group", gad)
+		w.ErrorToast(locale.Sprintf("Couldn't open %s", gad.String()))
+		return
+	}
+	if view.me.InGroup(gad) {
+		w.Toast("You're already a member of this group")
+		return
+	}
+	view.join(code, func() {})
+}
+
+// setLoggedIn is called once the main view is displayed, it handles an invite link that was
+// opened before that.
+func (w *Window) setLoggedIn() {
+	w.loggedIn = true
+	if w.pendingInvite == "" {
+		return
+	}
+	link := w.pendingInvite
+	w.pendingInvite = ""
+	w.OpenInviteLink(link)
+}
+
+// showCreateInviteDialog makes a new invite code for this group and displays a link to it that can be copied.
+func (v *GroupView) showCreateInviteDialog() {
+	window := app.GTKWindowFromContext(v.ctx)
+	dialog := adw.NewMessageDialog(window, locale.Get("Invite Link"), locale.Get("Creating an invite code..."))
+	dialog.AddResponse("close", locale.Get("_Close"))
+	dialog.AddResponse("copy", locale.Get("_Copy Link"))
+	dialog.SetResponseAppearance("copy", adw.ResponseSuggested)
+	dialog.SetResponseEnabled("copy", false)
+	dialog.SetDefaultResponse("copy")
+	dialog.SetCloseResponse("close")
+
+	link := gtk.NewLabel("")
+	link.SetSelectable(true)
+	link.SetWrap(true)
+	link.SetWrapMode(pango.WrapChar)
+	link.SetVisible(false)
+	dialog.SetExtraChild(link)
+
+	dialog.ConnectResponse(func(response string) {
+		switch response {
+		case "copy":
+			dialog.Clipboard().SetText(link.Label())
+			win.Toast("Invite link copied")
+		}
+	})
+	dialog.Show()
+
+	go func() {
+		code, err := v.group.CreateInvite(v.ctx)
+
+		glib.IdleAdd(func() {
+			if err != nil {
+				slog.Warn(err.Error())
+				dialog.SetBody(strings.Replace(err.Error(), " msg: ", " ", 1))
+				return
+			}
+
+			dialog.SetBody(locale.Sprintf("Anyone with this link can join %s using the code %s.", v.group.Name, code))
+			link.SetLabel(inviteLink(v.group.Address, code))
+			link.SetVisible(true)
+			dialog.SetResponseEnabled("copy", true)
+		})
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr/nip29"
+)
+
+func TestInviteLinkRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		gad  nip29.GroupAddress
+		code string
+	}{
+		{"wss relay", nip29.GroupAddress{Relay: "wss://groups.fiatjaf.com", ID: "abcdef"}, "123456"},
+		{"ws relay", nip29.GroupAddress{Relay: "ws://localhost:5577", ID: "abcdef"}, "123456"},
+		{"relay with a path", nip29.GroupAddress{Relay: "wss://relay.example.com/groups", ID: "abcdef"}, "123456"},
+		{"characters that must be escaped", nip29.GroupAddress{Relay: "wss://groups.fiatjaf.com", ID: "a b&c=d"}, "x/y?z#"},
+		{"no code", nip29.GroupAddress{Relay: "wss://groups.fiatjaf.com", ID: "abcdef"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			link := inviteLink(tc.gad, tc.code)
+
+			gad, code, ok := parseInviteLink(link)
+			if !ok {
+				t.Fatalf("parseInviteLink(%q) failed", link)
+			}
+			if !gad.Equals(tc.gad) {
+				t.Errorf("group is %v, want %v", gad, tc.gad)
+			}
+			if code != tc.code {
+				t.Errorf("code is %q, want %q", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestParseInviteLink(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		link string
+		gad  nip29.GroupAddress
+		code string
+		ok   bool
+	}{
+		{
+			"relay without the scheme",
+			"shiitake://join?relay=groups.fiatjaf.com&group=abcdef&code=123456",
+			nip29.GroupAddress{Relay: "wss://groups.fiatjaf.com", ID: "abcdef"}, "123456", true,
+		},
+		{
+			"surrounding spaces",
+			"  shiitake://join?relay=wss%3A%2F%2Fgroups.fiatjaf.com&group=abcdef&code=123456\n",
+			nip29.GroupAddress{Relay: "wss://groups.fiatjaf.com", ID: "abcdef"}, "123456", true,
+		},
+		{"other scheme", "https://join?relay=groups.fiatjaf.com&group=abcdef", nip29.GroupAddress{}, "", false},
+		{"other action", "shiitake://leave?relay=groups.fiatjaf.com&group=abcdef", nip29.GroupAddress{}, "", false},
+		{"no group", "shiitake://join?relay=groups.fiatjaf.com&code=123456", nip29.GroupAddress{}, "", false},
+		{"no relay", "shiitake://join?group=abcdef&code=123456", nip29.GroupAddress{}, "", false},
+		{"not a link", "%%%", nip29.GroupAddress{}, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gad, code, ok := parseInviteLink(tc.link)
+			if ok != tc.ok {
+				t.Fatalf("parseInviteLink(%q) ok = %v, want %v", tc.link, ok, tc.ok)
+			}
+			if !ok {
+				return
+			}
+			if !gad.Equals(tc.gad) {
+				t.Errorf("group is %v, want %v", gad, tc.gad)
+			}
+			if code != tc.code {
+				t.Errorf("code is %q, want %q", code, tc.code)
+			}
+		})
+	}
+}
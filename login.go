@@ -115,6 +115,7 @@ func (p *LoginPage) login(input, password string) error {
 	win.Stack.SetVisibleChild(win.main)
 	win.main.Groups.switchTo(nip29.GroupAddress{})
 	win.SetTitle("Chat")
+	win.setLoggedIn()
 	return nil
 }
 
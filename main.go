@@ -8,6 +8,7 @@ import (
 	"github.com/diamondburned/adaptive"
 	"github.com/diamondburned/chatkit/md/hl"
 	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
+	"github.com/diamondburned/gotk4/pkg/gio/v2"
 	"github.com/diamondburned/gotkit/app"
 	"github.com/diamondburned/gotkit/app/locale"
 	"github.com/diamondburned/gotkit/app/prefs"
@@ -15,6 +16,7 @@ import (
 	"github.com/diamondburned/gotkit/gtkutil/textutil"
 
 	"fiatjaf.com/shiitake/about"
+	"fiatjaf.com/shiitake/global"
 	_ "fiatjaf.com/shiitake/icons"
 	_ "github.com/diamondburned/gotkit/gtkutil/aggressivegc"
 )
@@ -45,7 +47,14 @@ var (
 func main() {
 	cssutil.WriteCSS(css)
 
-	application = app.New(context.Background(), "com.fiatjaf.shiitake", "Shiitake")
+	// we handle shiitake:// invite links that are opened with us
+	application = app.NewWithFlags(context.Background(), "com.fiatjaf.shiitake", "Shiitake", gio.ApplicationHandlesOpen)
+	application.ConnectOpen(func(files []gio.Filer, hint string) {
+		application.Activate()
+		for _, file := range files {
+			win.OpenInviteLink(file.URI())
+		}
+	})
 	application.ConnectActivate(func() {
 		ctx := application.Context()
 		adw.Init()
@@ -57,6 +66,7 @@ func main() {
 		}
 
 		win = NewWindow(ctx)
+		global.AskForAuth = askForAuth
 		win.Show()
 
 		prefs.AsyncLoadSaved(ctx, func(err error) {
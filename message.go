@@ -5,13 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
-	"time"
 
 	"fiatjaf.com/nostr-gtk/components/avatar"
 	"fiatjaf.com/shiitake/global"
 	"github.com/diamondburned/chatkit/md/hl"
 	"github.com/diamondburned/gotk4-adwaita/pkg/adw"
 	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"github.com/diamondburned/gotk4/pkg/pango"
 	"github.com/diamondburned/gotkit/app/locale"
@@ -19,159 +19,306 @@ import (
 	"github.com/diamondburned/gotkit/gtkutil/textutil"
 	"github.com/dustin/go-humanize"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/nbd-wtf/go-nostr/sdk"
 )
 
 type Message struct {
 	*gtk.Box
 	ctx    context.Context
+	view   *GroupView
 	Avatar *avatar.Avatar
 
 	message
-	tooltip string // markup
+	messageBox *gtk.Box
+	rightBox   *gtk.Box
+	emptySpace *gtk.Box
+	name       *gtk.Label
+	badges     *gtk.Box
+	outOfPlace *gtk.Image // shown when the message references events we've never seen
+	timestamp  *gtk.Label
+	delivery   *gtk.Image // how sending our message is going
+	failed     *gtk.Box   // lets us retry or discard a message that couldn't be sent
+	topLabel   *gtk.Box
+	tooltip    string // markup
+	actions    map[string]func()
 }
 
-func NewMessage(
-	ctx context.Context,
-	event *nostr.Event,
-	fromLoggedUser bool,
-	authorIsTheSameAsPrevious bool,
-) *Message {
+// NewMessage creates an empty message widget that will only display something after Bind is called.
+// these widgets are recycled by the chat list, so the same one is bound to many different events.
+func NewMessage(ctx context.Context, view *GroupView) *Message {
 	m := &Message{
-		ctx: ctx,
-		Box: gtk.NewBox(gtk.OrientationHorizontal, 0),
+		ctx:  ctx,
+		view: view,
+		Box:  gtk.NewBox(gtk.OrientationHorizontal, 0),
 		message: message{
-			Content: NewContent(ctx, event),
-			Event:   event,
+			ctx: ctx,
 		},
 	}
 	m.message.parent = m
 
-	messageBox := gtk.NewBox(gtk.OrientationHorizontal, 0)
-	messageBox.AddCSSClass(fmt.Sprintf("msg-bg-%s", event.PubKey[63:64]))
-	messageBox.AddCSSClass("p-2")
-	messageBox.AddCSSClass("mx-2")
-	messageBox.AddCSSClass("rounded")
+	m.messageBox = gtk.NewBox(gtk.OrientationHorizontal, 0)
+	m.messageBox.AddCSSClass("p-2")
+	m.messageBox.AddCSSClass("mx-2")
+	m.messageBox.AddCSSClass("rounded")
+
+	m.name = gtk.NewLabel("")
+	m.name.AddCSSClass("font-bold")
+	m.name.SetMaxWidthChars(15)
+	m.name.SetEllipsize(pango.EllipsizeEnd)
+	m.name.SetSingleLineMode(true)
+
+	m.timestamp = gtk.NewLabel("")
+	m.timestamp.AddCSSClass("text-zinc-500")
+	m.timestamp.AddCSSClass("text-xs")
+	m.timestamp.AddCSSClass("ml-4")
+	m.timestamp.AddCSSClass("mr-2")
+	m.timestamp.SetYAlign(1)
+	m.timestamp.SetHAlign(gtk.AlignEnd)
+	m.timestamp.SetHExpand(true)
+	m.timestamp.SetSingleLineMode(true)
+
+	m.badges = gtk.NewBox(gtk.OrientationHorizontal, 0)
+
+	m.outOfPlace = gtk.NewImageFromIconName("dialog-warning-symbolic")
+	m.outOfPlace.AddCSSClass("warning")
+	m.outOfPlace.AddCSSClass("ml-1")
+	m.outOfPlace.SetTooltipText("This message references events that aren't in this group's timeline, it may have been copied from somewhere else or come from a forked timeline. Only messages, reactions and moderation events are checked, so references to anything else are also shown here.")
+
+	m.delivery = gtk.NewImage()
+	m.delivery.AddCSSClass("mr-2")
+	m.delivery.SetVAlign(gtk.AlignEnd)
+
+	m.topLabel = gtk.NewBox(gtk.OrientationHorizontal, 0)
+	m.topLabel.Append(m.name)
+	m.topLabel.Append(m.badges)
+	m.topLabel.Append(m.outOfPlace)
+	m.topLabel.Append(m.timestamp)
+	m.topLabel.Append(m.delivery)
+
+	retry := gtk.NewButtonWithLabel(locale.Get("Retry"))
+	retry.AddCSSClass("flat")
+	retry.ConnectClicked(func() { m.view.RetrySending(m.message.Event.ID) })
+
+	discard := gtk.NewButtonWithLabel(locale.Get("Discard"))
+	discard.AddCSSClass("flat")
+	discard.AddCSSClass("destructive-action")
+	discard.ConnectClicked(func() { m.view.Discard(m.message.Event.ID) })
+
+	m.failed = gtk.NewBox(gtk.OrientationHorizontal, 6)
+	m.failed.SetHAlign(gtk.AlignEnd)
+	m.failed.Append(retry)
+	m.failed.Append(discard)
+
+	m.rightBox = gtk.NewBox(gtk.OrientationVertical, 0)
+	m.rightBox.SetHExpand(true)
+	m.rightBox.Append(m.topLabel)
+	m.rightBox.Append(m.failed)
+
+	m.emptySpace = gtk.NewBox(gtk.OrientationHorizontal, 0)
+	m.emptySpace.SetSizeRequest(win.Size(gtk.OrientationHorizontal)*4/10, -1)
+
+	m.Avatar = avatar.New(ctx, 30, "")
+	m.Avatar.SetVAlign(gtk.AlignCenter)
+	m.Avatar.AddCSSClass("mr-2")
+
+	m.messageBox.Append(m.Avatar)
+	m.messageBox.Append(m.rightBox)
+
+	m.Box.Append(m.messageBox)
+	m.Box.Append(m.emptySpace)
+
+	// the menu items are only decided when the menu is opened, as they depend on the event we're bound to
+	gtkutil.BindPopoverMenuLazy(m, gtk.PosTop, m.menuItems)
 
-	guctx, cancel := context.WithTimeout(ctx, time.Second*2)
-	user := global.GetUser(guctx, event.PubKey)
-	cancel()
+	return m
+}
 
-	name := gtk.NewLabel(user.ShortName())
-	name.AddCSSClass("font-bold")
-	if fromLoggedUser || authorIsTheSameAsPrevious {
-		// hide the name
-		name.AddCSSClass("opacity-0")
-	}
-	name.SetMaxWidthChars(15)
-	name.SetEllipsize(pango.EllipsizeEnd)
-	name.SetSingleLineMode(true)
-
-	timestamp := gtk.NewLabel(humanize.Time(event.CreatedAt.Time()))
-	timestamp.AddCSSClass("text-zinc-500")
-	timestamp.AddCSSClass("text-xs")
-	timestamp.AddCSSClass("ml-4")
-	timestamp.AddCSSClass("mr-2")
-	timestamp.SetYAlign(1)
-	timestamp.SetHAlign(gtk.AlignEnd)
-	timestamp.SetHExpand(true)
-	timestamp.SetSingleLineMode(true)
-
-	tooltip := fmt.Sprintf(
-		"<b>%s</b> (%s)\n%s",
-		html.EscapeString(user.ShortName()), user.Npub(),
-		html.EscapeString(locale.Time(event.CreatedAt.Time(), true)),
-	)
+// Unbind stops loading anything for the event this widget was displaying.
+func (m *Message) Unbind() {
+	if m.message.cancel != nil {
+		m.message.cancel()
+		m.message.cancel = nil
+	}
+}
 
-	topLabel := gtk.NewBox(gtk.OrientationHorizontal, 0)
-	topLabel.Append(name)
-	topLabel.Append(timestamp)
-	topLabel.SetTooltipMarkup(tooltip)
-	if fromLoggedUser {
-		topLabel.SetHAlign(gtk.AlignEnd)
+// Bind makes this widget display the given event, replacing whatever it was displaying before.
+func (m *Message) Bind(event *nostr.Event, fromLoggedUser bool, authorIsTheSameAsPrevious bool) {
+	if m.message.Event != nil {
+		m.messageBox.RemoveCSSClass(fmt.Sprintf("msg-bg-%s", m.message.Event.PubKey[63:64]))
 	}
+	if m.message.Content != nil {
+		m.rightBox.Remove(m.message.Content)
+	}
+	m.Unbind()
 
-	rightBox := gtk.NewBox(gtk.OrientationVertical, 0)
-	rightBox.SetHExpand(true)
-	rightBox.Append(topLabel)
+	// whatever the content is still loading for the previous event is canceled when it's replaced
+	var ctx context.Context
+	ctx, m.message.cancel = context.WithCancel(m.ctx)
 
-	rightBox.Append(m.message.Content)
+	m.message.Event = event
+	m.message.Content = NewContent(ctx, m.view, event)
+	m.rightBox.InsertChildAfter(m.message.Content, m.topLabel)
 
-	emptySpace := gtk.NewBox(gtk.OrientationHorizontal, 0)
-	emptySpace.SetSizeRequest(win.Size(gtk.OrientationHorizontal)*4/10, -1)
+	m.messageBox.AddCSSClass(fmt.Sprintf("msg-bg-%s", event.PubKey[63:64]))
+	if m.view.chat.replyingTo == event.ID {
+		m.messageBox.AddCSSClass("message-replying")
+	} else {
+		m.messageBox.RemoveCSSClass("message-replying")
+	}
 
-	if !fromLoggedUser {
+	if fromLoggedUser || authorIsTheSameAsPrevious {
+		// hide the name
+		m.name.AddCSSClass("opacity-0")
+		m.badges.SetVisible(false)
+	} else {
+		m.name.RemoveCSSClass("opacity-0")
+		m.badges.SetVisible(true)
+		m.setRoles(m.view.group.Members[event.PubKey])
+	}
+
+	m.timestamp.SetText(humanize.Time(event.CreatedAt.Time()))
+	m.outOfPlace.SetVisible(len(m.view.group.UnknownPrevious(event)) > 0)
+	m.setDelivery(m.view.chat.delivery[event.ID])
+
+	if fromLoggedUser {
 		// hide the avatar if it's us
-		avatar := avatar.New(ctx, 30, event.PubKey)
-		avatar.SetVAlign(gtk.AlignCenter)
-		avatar.SetTooltipMarkup(tooltip)
-		avatar.SetFromURL(user.Picture)
-		avatar.AddCSSClass("mr-2")
-		messageBox.Append(avatar)
+		m.Avatar.SetVisible(false)
 
+		// first an empty space, then the message
+		m.topLabel.SetHAlign(gtk.AlignEnd)
+		m.Box.SetHAlign(gtk.AlignEnd)
+		m.Box.ReorderChildAfter(m.messageBox, m.emptySpace)
+	} else {
+		m.Avatar.SetVisible(true)
 		if authorIsTheSameAsPrevious {
 			// hide the avatar if it's the same as the previous
-			avatar.AddCSSClass("opacity-0")
+			m.Avatar.AddCSSClass("opacity-0")
+		} else {
+			m.Avatar.RemoveCSSClass("opacity-0")
 		}
 
 		// first the message, then an empty space
+		m.topLabel.SetHAlign(gtk.AlignFill)
 		m.Box.SetHAlign(gtk.AlignStart)
-		m.Box.Append(messageBox)
-		m.Box.Append(emptySpace)
-	} else {
-		// first the message, then an empty space
-		m.Box.SetHAlign(gtk.AlignEnd)
-		m.Box.Append(emptySpace)
-		m.Box.Append(messageBox)
+		m.Box.ReorderChildAfter(m.emptySpace, m.messageBox)
 	}
 
-	messageBox.Append(rightBox)
+	// we start with a placeholder and fill in the actual profile once it is loaded
+	m.Avatar.SetCustomImage(nil)
+	m.Avatar.SetText(event.PubKey)
+	m.setUser(global.User{ProfileMetadata: sdk.ProfileMetadata{PubKey: event.PubKey}})
+	global.RequestUser(m.ctx, event.PubKey, func(user global.User) {
+		glib.IdleAdd(func() {
+			if m.message.Event == event {
+				m.setUser(user)
+			}
+		})
+	})
 
-	// bind menu actions
-	if m.message.Menu != nil {
-		return m
-	}
+	m.bindActions()
+}
 
-	actions := map[string]func(){
+func (m *Message) bindActions() {
+	event := m.message.Event
+	m.actions = map[string]func(){
 		"message.show-source": func() { m.message.ShowSource() },
-		// "message.reply":       func() { win.main.Groups.ReplyTo(msg.Event.ID) },
 	}
 
-	me := global.GetMe(ctx)
+	if m.view.me.InGroup(m.view.group.Address) {
+		m.actions["message.reply"] = func() { m.view.ReplyTo(event.ID) }
+		m.actions["message.add-reaction"] = func() { m.message.ShowEmojiChooser() }
+	}
+
+	if d, ok := m.view.chat.delivery[event.ID]; ok && d.state != deliverySent {
+		// it isn't in the group yet, so there is nothing to reply to or delete there
+		delete(m.actions, "message.reply")
+		delete(m.actions, "message.add-reaction")
+		if d.state == deliveryFailed {
+			m.actions["message.retry"] = func() { m.view.RetrySending(event.ID) }
+		}
+		if d.state == deliveryFailed || d.state == deliveryQueued {
+			m.actions["message.discard"] = func() { m.view.Discard(event.ID) }
+		}
+	} else if event.PubKey == m.view.me.PubKey || m.view.group.IsAdmin(m.view.me.PubKey) {
+		m.actions["message.delete"] = func() { m.view.Delete(event.ID) }
+	}
+
+	gtkutil.BindActionMap(m, m.actions)
 
-	// if me != nil && m.message.PubKey == me.PubKey {
-	// 	actions["message.edit"] = func() { m.view().Edit(m.message.ID) }
-	// 	actions["message.delete"] = func() { m.view().Delete(m.message.ID) }
-	// }
+	m.message.Menu = gtkutil.CustomMenu(m.menuItems())
+	m.message.Content.SetExtraMenu(m.message.Menu)
+}
 
-	if me != nil && m.message.Event.PubKey == me.PubKey /* TODO: admins should also be able to delete */ {
-		// actions["message.delete"] = func() { win.main.Messages.Delete(msg.Event.ID) }
+func (m *Message) menuItems() []gtkutil.PopoverMenuItem {
+	return []gtkutil.PopoverMenuItem{
+		menuItemIfOK(m.actions, "Add _Reaction", "message.add-reaction"),
+		menuItemIfOK(m.actions, "_Reply", "message.reply"),
+		menuItemIfOK(m.actions, "_Delete", "message.delete"),
+		menuItemIfOK(m.actions, "Re_try Sending", "message.retry"),
+		menuItemIfOK(m.actions, "D_iscard", "message.discard"),
+		menuItemIfOK(m.actions, "Show _Source", "message.show-source"),
 	}
+}
 
-	// 	if channel != nil && (channel.Type == discord.DirectMessage || channel.Type == discord.GroupDM) {
-	// 		actions["message.add-reaction"] = func() { m.ShowEmojiChooser() }
-	// 	}
+// setDelivery displays how sending this message is going, d is nil for messages that weren't sent from here.
+func (m *Message) setDelivery(d *delivery) {
+	m.failed.SetVisible(d != nil && d.state == deliveryFailed)
+	m.delivery.RemoveCSSClass("error")
+	if d == nil {
+		m.delivery.SetVisible(false)
+		return
+	}
 
-	menuItems := []gtkutil.PopoverMenuItem{
-		// menuItemIfOK(actions, "Add _Reaction", "message.add-reaction"),
-		menuItemIfOK(actions, "_Reply", "message.reply"),
-		// menuItemIfOK(actions, "_Edit", "message.edit"),
-		menuItemIfOK(actions, "_Delete", "message.delete"),
-		menuItemIfOK(actions, "Show _Source", "message.show-source"),
+	m.delivery.SetVisible(true)
+	switch d.state {
+	case deliveryPending:
+		m.delivery.SetFromIconName("emblem-synchronizing-symbolic")
+		m.delivery.SetTooltipText(locale.Get("Sending..."))
+	case deliveryQueued:
+		m.delivery.SetFromIconName("network-offline-symbolic")
+		m.delivery.SetTooltipText(locale.Get("Waiting for the relay to be reachable"))
+	case deliveryFailed:
+		m.delivery.SetFromIconName("dialog-error-symbolic")
+		m.delivery.AddCSSClass("error")
+		m.delivery.SetTooltipText(d.err.Error())
+	case deliverySent:
+		m.delivery.SetFromIconName("emblem-ok-symbolic")
+		m.delivery.SetTooltipText(locale.Get("Sent"))
 	}
+}
 
-	gtkutil.BindActionMap(m.message.parent, actions)
-	gtkutil.BindPopoverMenuCustom(m.message.parent, gtk.PosTop, menuItems)
+// setRoles displays a badge for each role the author has in the group.
+func (m *Message) setRoles(roles []*nip29.Role) {
+	for child := m.badges.FirstChild(); child != nil; child = m.badges.FirstChild() {
+		m.badges.Remove(child)
+	}
+	for _, role := range roles {
+		m.badges.Append(newRoleBadge(role))
+	}
+}
 
-	m.message.Menu = gtkutil.CustomMenu(menuItems)
-	m.message.Content.SetExtraMenu(m.message.Menu)
+// setUser updates everything that displays the author of this message.
+func (m *Message) setUser(user global.User) {
+	m.tooltip = fmt.Sprintf(
+		"<b>%s</b> (%s)\n%s",
+		html.EscapeString(user.ShortName()), user.Npub(),
+		html.EscapeString(locale.Time(m.message.Event.CreatedAt.Time(), true)),
+	)
 
-	return m
+	m.name.SetText(user.ShortName())
+	m.topLabel.SetTooltipMarkup(m.tooltip)
+	m.Avatar.SetTooltipMarkup(m.tooltip)
+	if user.Picture != "" {
+		m.Avatar.SetFromURL(user.Picture)
+	}
 }
 
 // message is a base that implements Message.
 type message struct {
 	parent *Message
 	ctx    context.Context
+	cancel context.CancelFunc // stops loading what the content needs
 
 	Content *Content
 	Event   *nostr.Event
@@ -185,13 +332,16 @@ func menuItemIfOK(actions map[string]func(), label locale.Localized, action stri
 
 // ShowEmojiChooser opens a Gtk.EmojiChooser popover.
 func (msg *message) ShowEmojiChooser() {
+	// the row may be showing another message by the time an emoji is picked
+	id := msg.Event.ID
+
 	e := gtk.NewEmojiChooser()
-	e.SetParent(msg.Content)
+	e.SetParent(msg.parent)
 	e.SetHasArrow(false)
+	e.ConnectClosed(e.Unparent)
 
 	e.ConnectEmojiPicked(func(text string) {
-		// emoji := discord.APIEmoji(text)
-		// win.main.Messages.AddReaction(msg.Content.MessageID, emoji)
+		msg.parent.view.ToggleReaction(id, text)
 	})
 
 	e.Present()
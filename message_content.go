@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
 
 	"fiatjaf.com/shiitake/global"
 	"github.com/diamondburned/chatkit/components/author"
 	"github.com/diamondburned/gotk4/pkg/gio/v2"
+	"github.com/diamondburned/gotk4/pkg/glib/v2"
 	"github.com/diamondburned/gotk4/pkg/gtk/v4"
 	"github.com/diamondburned/gotk4/pkg/pango"
 	"github.com/diamondburned/gotkit/app/locale"
@@ -18,15 +23,17 @@ import (
 type Content struct {
 	*gtk.Box
 	ctx   context.Context
+	view  *GroupView
 	menu  *gio.Menu
 	child []gtk.Widgetter
 
 	MessageID string
 }
 
-func NewContent(ctx context.Context, event *nostr.Event) *Content {
+func NewContent(ctx context.Context, view *GroupView, event *nostr.Event) *Content {
 	c := Content{
 		ctx:       ctx,
+		view:      view,
 		child:     make([]gtk.Widgetter, 0, 2),
 		MessageID: event.ID,
 	}
@@ -34,23 +41,32 @@ func NewContent(ctx context.Context, event *nostr.Event) *Content {
 
 	c.clear()
 
-	msg := gtk.NewLabel("")
-	msg.SetText(event.Content)
-	msg.SetSelectable(true)
-	msg.SetHExpand(true)
-	msg.SetXAlign(0)
-	msg.SetWrap(true)
-	msg.SetWrapMode(pango.WrapWordChar)
-	msg.ConnectActivateLink(func(uri string) bool {
-		return true
-	})
-	fixNatWrap(msg)
-	c.append(msg)
+	if tag := event.Tags.GetFirst([]string{"e", ""}); tag != nil {
+		c.append(c.newReplyBox((*tag)[1]))
+	}
 
-	// if m.Reference != nil {
-	// 	w := c.newReplyBox(m)
-	// 	c.append(w)
-	// }
+	if renderMarkdown.Value() {
+		for _, w := range newMarkdownContent(ctx, event.Content) {
+			c.append(w)
+		}
+	} else {
+		msg := gtk.NewLabel("")
+		msg.SetText(event.Content)
+		msg.SetSelectable(true)
+		msg.SetHExpand(true)
+		msg.SetXAlign(0)
+		msg.SetWrap(true)
+		msg.SetWrapMode(pango.WrapWordChar)
+		msg.ConnectActivateLink(func(uri string) bool {
+			return true
+		})
+		fixNatWrap(msg)
+		c.append(msg)
+	}
+
+	if reactions := view.group.ReactionsTo(event.ID); len(reactions) > 0 {
+		c.append(c.newReactionBar(reactions))
+	}
 
 	// var messageMarkup string
 	// switch m.Type {
@@ -150,81 +166,125 @@ func (c *Content) setMenu() {
 	}
 }
 
-func (c *Content) newReplyBox(m *nostr.Event) gtk.Widgetter {
-	box := gtk.NewBox(gtk.OrientationVertical, 0)
-
-	// state := gtkcord.FromContext(c.ctx)
-
-	// referencedMsg := m.ReferencedMessage
-	// if referencedMsg == nil {
-	// 	referencedMsg, _ = state.Cabinet.Message(m.Reference.ChannelID, m.Reference.MessageID)
-	// }
-
-	// if referencedMsg == nil {
-	// 	slog.Warn(
-	// 		"Cannot display message reference because the message is not found",
-	// 		"channel_id", m.ChannelID,
-	// 		"guild_id", m.GuildID,
-	// 		"id", m.ID,
-	// 		"id_reference", m.Reference.MessageID)
-
-	// 	header := gtk.NewLabel("Unknown message.")
-	// 	box.Append(header)
+// newReplyBox displays a preview of the message being replied to, which can be clicked to go to it.
+// the parent is taken from the messages we have displayed or fetched from the relay when it isn't there,
+// only once, as messages are bound again all the time while scrolling.
+func (c *Content) newReplyBox(parentID string) gtk.Widgetter {
+	box := gtk.NewBox(gtk.OrientationHorizontal, 0)
+	box.AddCSSClass("mb-1")
+	box.AddCSSClass("opacity-75")
+
+	reply := gtk.NewLabel(locale.Get("Loading reply..."))
+	reply.AddCSSClass("text-xs")
+	reply.SetEllipsize(pango.EllipsizeEnd)
+	reply.SetSingleLineMode(true)
+	reply.SetHExpand(true)
+	reply.SetXAlign(0)
+	reply.ConnectActivateLink(func(link string) bool {
+		if link != "shiitake://reply" {
+			return false
+		}
+		c.view.ScrollToMessage(parentID)
+		return true
+	})
+	box.Append(reply)
+
+	setParent := func(parent *nostr.Event, user global.User) {
+		chip := newAuthorChip(c.ctx, "", user)
+		chip.SetHAlign(gtk.AlignStart)
+		chip.Unpad()
+		box.Prepend(chip)
+
+		// force single line
+		preview := strings.ReplaceAll(parent.Content, "\n", "  ")
+		reply.SetMarkup(fmt.Sprintf(`<a href="shiitake://reply">%s</a>`, html.EscapeString(preview)))
+		reply.SetTooltipText(preview)
+	}
 
-	// 	return box
-	// }
+	parent, ok := c.view.chat.messages[parentID]
+	if !ok {
+		parent, ok = c.view.chat.parents[parentID]
+	}
+	if ok && parent == nil {
+		reply.SetText(locale.Get("Unknown message."))
+		return box
+	}
 
-	// member, _ := state.Cabinet.Member(m.Reference.GuildID, referencedMsg.Author.ID)
-	chip := newAuthorChip(c.ctx, "", global.GetUser(c.ctx, m.PubKey))
-	chip.SetHAlign(gtk.AlignStart)
-	chip.Unpad()
-	box.Append(chip)
+	go func() {
+		if !ok {
+			var err error
+			parent, err = c.view.group.GetMessage(c.ctx, parentID)
+			if c.ctx.Err() != nil {
+				// this isn't displayed anymore, whatever displays it next will look for it again
+				return
+			}
 
-	// if preview := state.MessagePreview(referencedMsg); preview != "" {
-	// 	// Force single line.
-	// 	preview = strings.ReplaceAll(preview, "\n", "  ")
-	// 	markup := fmt.Sprintf(
-	// 		`<a href="dissent://reply">%s</a>`,
-	// 		html.EscapeString(preview),
-	// 	)
-
-	// 	reply := gtk.NewLabel(markup)
-	// 	reply.SetUseMarkup(true)
-	// 	reply.SetTooltipText(preview)
-	// 	reply.SetEllipsize(pango.EllipsizeEnd)
-	// 	reply.SetLines(1)
-	// 	reply.SetXAlign(0)
-	// 	reply.ConnectActivateLink(func(link string) bool {
-	// 		slog.Debug(
-	// 			"Activated message reference link",
-	// 			"link", link,
-	// 			"message_id", m.ID,
-	// 			"reference_id", referencedMsg.ID)
-
-	// 		if link != "dissent://reply" {
-	// 			return false
-	// 		}
+			glib.IdleAdd(func() { c.view.chat.parents[parentID] = parent })
+			if err != nil {
+				slog.Warn("cannot display message reference", "id", parentID, "err", err)
+				glib.IdleAdd(func() { reply.SetText(locale.Get("Unknown message.")) })
+				return
+			}
+		}
 
-	// 		if !c.ActivateAction("messages.scroll-to", gtkcord.NewMessageIDVariant(m.ID)) {
-	// TODO: call function on parent directly instead of emitting this event thing
-	// 			slog.Error(
-	// 				"Failed to activate messages.scroll-to",
-	// 				"id", m.ID)
-	// 		}
+		user := global.GetUser(c.ctx, parent.PubKey)
+		if c.ctx.Err() != nil {
+			return
+		}
+		glib.IdleAdd(func() { setParent(parent, user) })
+	}()
 
-	// 		return true
-	// 	})
+	return box
+}
 
-	// 	box.Append(reply)
-	// }
+// newReactionBar displays the reactions grouped by emoji, clicking one of them toggles our own reaction.
+func (c *Content) newReactionBar(reactions []*nostr.Event) gtk.Widgetter {
+	box := gtk.NewBox(gtk.OrientationHorizontal, 4)
+	box.AddCSSClass("mt-1")
+
+	emojis := make([]string, 0, len(reactions))
+	count := make(map[string]int, len(reactions))
+	mine := make(map[string]bool, 1)
+	for _, reaction := range reactions {
+		if _, ok := count[reaction.Content]; !ok {
+			emojis = append(emojis, reaction.Content)
+		}
+		count[reaction.Content]++
+		if reaction.PubKey == c.view.me.PubKey {
+			mine[reaction.Content] = true
+		}
+	}
 
-	// if state.UserIsBlocked(referencedMsg.Author.ID) {
-	// 	blockedCSS(box)
-	// }
+	for _, emoji := range emojis {
+		button := gtk.NewButtonWithLabel(fmt.Sprintf("%s %d", displayReaction(emoji), count[emoji]))
+		button.AddCSSClass("text-xs")
+		button.AddCSSClass("px-2")
+		button.AddCSSClass("py-0")
+		if !mine[emoji] {
+			// our own reactions stand out
+			button.AddCSSClass("flat")
+		}
+		button.ConnectClicked(func() {
+			c.view.ToggleReaction(c.MessageID, emoji)
+		})
+		box.Append(button)
+	}
 
 	return box
 }
 
+// displayReaction turns the special NIP-25 reactions into something that looks like the others.
+func displayReaction(content string) string {
+	switch content {
+	case "", "+":
+		return "👍"
+	case "-":
+		return "👎"
+	default:
+		return content
+	}
+}
+
 func (c *Content) newInteractionBox(m *nostr.Event) gtk.Widgetter {
 	box := gtk.NewBox(gtk.OrientationHorizontal, 0)
 
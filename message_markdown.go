@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/diamondburned/chatkit/md/hl"
+	"github.com/diamondburned/gotk4/pkg/gtk/v4"
+	"github.com/diamondburned/gotk4/pkg/pango"
+	"github.com/diamondburned/gotkit/app/prefs"
+)
+
+var renderMarkdown = prefs.NewBool(true, prefs.PropMeta{
+	Name:        "Format Messages",
+	Description: "Display the Markdown in messages (emphasis, code, quotes and links) instead of the raw characters.",
+	Section:     "Messages",
+})
+
+// we only understand a small subset of Markdown, which is what people actually use in chats.
+// everything written by others is escaped before it goes into a label, and all the markup comes
+// from us, so a message can never inject its own Pango markup.
+
+type markdownBlockKind int
+
+const (
+	markdownParagraph markdownBlockKind = iota
+	markdownQuote
+	markdownCode
+)
+
+type markdownBlock struct {
+	kind     markdownBlockKind
+	text     string
+	language string // of code blocks
+}
+
+// parseMarkdownBlocks splits a message into paragraphs, block quotes and fenced code blocks.
+func parseMarkdownBlocks(content string) []markdownBlock {
+	var blocks []markdownBlock
+	var current *markdownBlock
+	var lines []string
+
+	flush := func() {
+		if current != nil {
+			current.text = strings.Join(lines, "\n")
+			if current.kind == markdownCode || strings.TrimSpace(current.text) != "" {
+				blocks = append(blocks, *current)
+			}
+		}
+		current = nil
+		lines = nil
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indented := len(line)-len(trimmed) > 3
+
+		if current != nil && current.kind == markdownCode {
+			if !indented && strings.HasPrefix(trimmed, "```") && strings.TrimSpace(trimmed[3:]) == "" {
+				flush()
+			} else {
+				lines = append(lines, line)
+			}
+			continue
+		}
+
+		switch {
+		case !indented && strings.HasPrefix(trimmed, "```"):
+			flush()
+			current = &markdownBlock{kind: markdownCode, language: strings.TrimSpace(trimmed[3:])}
+		case !indented && strings.HasPrefix(trimmed, ">"):
+			if current == nil || current.kind != markdownQuote {
+				flush()
+				current = &markdownBlock{kind: markdownQuote}
+			}
+			quoted := strings.TrimPrefix(trimmed, ">")
+			lines = append(lines, strings.TrimPrefix(quoted, " "))
+		default:
+			if current == nil || current.kind != markdownParagraph {
+				flush()
+				current = &markdownBlock{kind: markdownParagraph}
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	// an unterminated code block goes on until the end of the message
+	flush()
+
+	return blocks
+}
+
+// markdownInline turns emphasis, inline code and links into Pango markup, escaping everything else.
+func markdownInline(text string) string { return markdownInlineLinks(text, true) }
+
+// markdownInlineLinks is markdownInline for text that may already be inside a link, as those can't be nested.
+func markdownInlineLinks(text string, links bool) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		markup, n := markdownTokenAt(text, i, links)
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(text[i:])
+			markup = html.EscapeString(text[i : i+n])
+		}
+		b.WriteString(markup)
+		i += n
+	}
+	return b.String()
+}
+
+// markdownTokenAt returns the markup for the formatting that starts at i and how many bytes
+// of text it takes, or 0 if nothing starts there.
+func markdownTokenAt(text string, i int, links bool) (markup string, n int) {
+	if links {
+		if url := urlAt(text, i); url != "" {
+			return linkMarkup(url, html.EscapeString(url)), len(url)
+		}
+	}
+
+	switch text[i] {
+	case '\\':
+		if i+1 < len(text) && strings.IndexByte("\\`*_~[]()>", text[i+1]) != -1 {
+			return html.EscapeString(text[i+1 : i+2]), 2
+		}
+	case '`':
+		if end := strings.IndexByte(text[i+1:], '`'); end > 0 {
+			return "<tt>" + html.EscapeString(text[i+1:i+1+end]) + "</tt>", end + 2
+		}
+	case '[':
+		if label, url, n := linkAt(text, i); links && n > 0 {
+			return linkMarkup(url, markdownInlineLinks(label, false)), n
+		}
+	}
+
+	for _, style := range markdownEmphasis {
+		if inner, n := emphasisAt(text, i, style.delimiter); n > 0 {
+			return "<" + style.tag + ">" + markdownInlineLinks(inner, links) + "</" + style.tag + ">", n
+		}
+	}
+
+	return "", 0
+}
+
+// longer delimiters must come first so "**" isn't taken as two "*"
+var markdownEmphasis = []struct {
+	delimiter string
+	tag       string
+}{
+	{"**", "b"},
+	{"__", "b"},
+	{"~~", "s"},
+	{"*", "i"},
+	{"_", "i"},
+}
+
+// emphasisAt returns what is enclosed by the delimiter that starts at i, and how many bytes
+// the whole thing takes, or 0 if there is no emphasis there.
+func emphasisAt(text string, i int, delimiter string) (inner string, n int) {
+	if !strings.HasPrefix(text[i:], delimiter) {
+		return "", 0
+	}
+	start := i + len(delimiter)
+	if start >= len(text) || text[start] == ' ' || strings.HasPrefix(text[start:], delimiter[:1]) {
+		return "", 0
+	}
+
+	// snake_case_words aren't emphasis
+	intraword := delimiter[0] == '_'
+	if intraword && i > 0 && isWordByte(text[i-1]) {
+		return "", 0
+	}
+
+	for j := start; j < len(text); j++ {
+		switch {
+		case text[j] == '\\':
+			j++
+			continue
+		case text[j] == '`':
+			// the closing delimiter can't be inside inline code
+			if end := strings.IndexByte(text[j+1:], '`'); end > 0 {
+				j += end + 1
+			}
+			continue
+		case text[j] == '\n' && j+1 < len(text) && text[j+1] == '\n':
+			return "", 0
+		}
+		if url := urlAt(text, j); url != "" {
+			j += len(url) - 1
+			continue
+		}
+
+		if text[j] != delimiter[0] {
+			continue
+		}
+		run := len(text[j:]) - len(strings.TrimLeft(text[j:], delimiter[:1]))
+		if run != len(delimiter) || text[j-1] == ' ' {
+			// a different delimiter made of the same character, like "**" when we're looking for "*"
+			j += run - 1
+			continue
+		}
+		end := j + len(delimiter)
+		if intraword && end < len(text) && isWordByte(text[end]) {
+			continue
+		}
+		return text[start:j], end - i
+	}
+
+	return "", 0
+}
+
+// linkAt parses a [label](url) link starting at i, n is 0 if there is none or if the url isn't a web one.
+func linkAt(text string, i int) (label string, url string, n int) {
+	closeLabel := strings.Index(text[i:], "](")
+	if closeLabel == -1 {
+		return "", "", 0
+	}
+	closeURL := strings.IndexByte(text[i+closeLabel+2:], ')')
+	if closeURL == -1 {
+		return "", "", 0
+	}
+
+	label = text[i+1 : i+closeLabel]
+	url = strings.TrimSpace(text[i+closeLabel+2 : i+closeLabel+2+closeURL])
+	if label == "" || strings.ContainsAny(label, "[\n") || strings.ContainsAny(url, " \n") || !isWebURL(url) {
+		return "", "", 0
+	}
+
+	return label, url, closeLabel + 2 + closeURL + 1
+}
+
+// urlAt returns the bare web url that starts at i, if there is one.
+func urlAt(text string, i int) string {
+	if !isWebURL(text[i:]) || (i > 0 && isWordByte(text[i-1])) {
+		return ""
+	}
+
+	end := strings.IndexFunc(text[i:], func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("<>\"`", r)
+	})
+	if end == -1 {
+		end = len(text) - i
+	}
+
+	// punctuation at the end belongs to the sentence, not to the url
+	url := strings.TrimRight(text[i:i+end], ".,:;!?*_~)'")
+	if strings.Count(url, "(") > strings.Count(url, ")") && i+len(url) < len(text) && text[i+len(url)] == ')' {
+		url += ")"
+	}
+	if url == "http://" || url == "https://" {
+		return ""
+	}
+	return url
+}
+
+func linkMarkup(url string, labelMarkup string) string {
+	return `<a href="` + html.EscapeString(url) + `">` + labelMarkup + `</a>`
+}
+
+func isWebURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// newMarkdownContent makes the widgets that display a message formatted as Markdown.
+func newMarkdownContent(ctx context.Context, content string) []gtk.Widgetter {
+	blocks := parseMarkdownBlocks(content)
+	widgets := make([]gtk.Widgetter, 0, len(blocks))
+
+	for _, block := range blocks {
+		switch block.kind {
+		case markdownParagraph:
+			widgets = append(widgets, newMarkdownLabel(markdownInline(block.text)))
+
+		case markdownQuote:
+			quote := newMarkdownLabel(markdownInline(block.text))
+			quote.AddCSSClass("message-quote")
+			widgets = append(widgets, quote)
+
+		case markdownCode:
+			buf := gtk.NewTextBuffer(nil)
+			buf.SetText(block.text)
+			if block.language != "" {
+				hl.Highlight(ctx, buf.StartIter(), buf.EndIter(), block.language)
+			}
+
+			code := gtk.NewTextViewWithBuffer(buf)
+			code.SetEditable(false)
+			code.SetCursorVisible(false)
+			code.SetMonospace(true)
+			code.SetWrapMode(gtk.WrapNone)
+			code.AddCSSClass("message-code")
+
+			scroll := gtk.NewScrolledWindow()
+			scroll.SetPolicy(gtk.PolicyAutomatic, gtk.PolicyNever)
+			scroll.SetPropagateNaturalHeight(true)
+			scroll.SetHExpand(true)
+			scroll.AddCSSClass("my-1")
+			scroll.AddCSSClass("rounded")
+			scroll.SetChild(code)
+			widgets = append(widgets, scroll)
+		}
+	}
+
+	return widgets
+}
+
+func newMarkdownLabel(markup string) *gtk.Label {
+	label := gtk.NewLabel("")
+	label.SetMarkup(markup)
+	label.SetSelectable(true)
+	label.SetHExpand(true)
+	label.SetXAlign(0)
+	label.SetWrap(true)
+	label.SetWrapMode(pango.WrapWordChar)
+	label.ConnectActivateLink(func(uri string) bool {
+		// web links are opened by gtk, nothing else should get here
+		return !isWebURL(uri)
+	})
+	fixNatWrap(label)
+	return label
+}
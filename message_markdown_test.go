@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestMarkdownInline(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "hello there", "hello there"},
+		{"markup is escaped", "<b>not bold</b> & co", "&lt;b&gt;not bold&lt;/b&gt; &amp; co"},
+		{"bold", "**bold**", "<b>bold</b>"},
+		{"italic", "an *italic* word", "an <i>italic</i> word"},
+		{"strikethrough", "~~gone~~", "<s>gone</s>"},
+		{"italic inside bold", "**very *much* so**", "<b>very <i>much</i> so</b>"},
+		{"bold inside italic", "_so **very** much_", "<i>so <b>very</b> much</i>"},
+		{"unclosed", "**not closed", "**not closed"},
+		{"followed by a space", "* not a list", "* not a list"},
+		{"snake case", "some_snake_case_words", "some_snake_case_words"},
+		{"escaped delimiter", `\*not italic\*`, "*not italic*"},
+		{"escaped backslash", `a \\ b`, `a \ b`},
+		{"backslash before a letter", `C:\temp`, `C:\temp`},
+		{"inline code", "run `ls *.go` now", "run <tt>ls *.go</tt> now"},
+		{"code is escaped", "`<a>`", "<tt>&lt;a&gt;</tt>"},
+		{"delimiter inside code", "*a `*` b*", "<i>a <tt>*</tt> b</i>"},
+		{"link", "[the site](https://example.com)", `<a href="https://example.com">the site</a>`},
+		{"emphasis in a link", "[**bold** site](https://example.com)", `<a href="https://example.com"><b>bold</b> site</a>`},
+		{"not a web link", "[click](javascript:alert(1))", "[click](javascript:alert(1))"},
+		{"bare url", "see https://example.com/a_b_c.", `see <a href="https://example.com/a_b_c">https://example.com/a_b_c</a>.`},
+		{"url in emphasis", "*https://example.com/x*", `<i><a href="https://example.com/x">https://example.com/x</a></i>`},
+		{"url with an ampersand", "https://example.com/?a=1&b=2", `<a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a>`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := markdownInline(tc.text); got != tc.want {
+				t.Errorf("markdownInline(%q)\n got %q\nwant %q", tc.text, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEmphasisAt(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		text      string
+		i         int
+		delimiter string
+		inner     string
+		n         int
+	}{
+		{"simple", "*a*", 0, "*", "a", 3},
+		{"not at i", "a *b*", 0, "*", "", 0},
+		{"after text", "a *b*", 2, "*", "b", 3},
+		{"double", "**a**", 0, "**", "a", 5},
+		{"double is not single", "**a**", 0, "*", "", 0},
+		{"nested single in double", "**a *b* c**", 0, "**", "a *b* c", 11},
+		{"nested double in single", "*a **b** c*", 0, "*", "a **b** c", 11},
+		{"space after the opening", "* a*", 0, "*", "", 0},
+		{"space before the closing", "*a *", 0, "*", "", 0},
+		{"escaped closing", `*a\*b*`, 0, "*", `a\*b`, 6},
+		{"closing in code", "*a `*` b*", 0, "*", "a `*` b", 9},
+		{"closing in a url", "_https://example.com/a_b_", 0, "_", "https://example.com/a_b", 25},
+		{"across paragraphs", "*a\n\nb*", 0, "*", "", 0},
+		{"across lines", "*a\nb*", 0, "*", "a\nb", 5},
+		{"intraword underscore", "a_b_", 1, "_", "", 0},
+		{"underscore followed by a letter", "_a_b", 0, "_", "", 0},
+		{"empty", "**", 0, "*", "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner, n := emphasisAt(tc.text, tc.i, tc.delimiter)
+			if inner != tc.inner || n != tc.n {
+				t.Errorf("emphasisAt(%q, %d, %q) = %q, %d, want %q, %d", tc.text, tc.i, tc.delimiter, inner, n, tc.inner, tc.n)
+			}
+		})
+	}
+}
+
+func TestURLAt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		i    int
+		want string
+	}{
+		{"whole text", "https://example.com", 0, "https://example.com"},
+		{"plain http", "http://example.com/a", 0, "http://example.com/a"},
+		{"ends at a space", "https://example.com and more", 0, "https://example.com"},
+		{"period", "https://example.com.", 0, "https://example.com"},
+		{"several punctuation marks", "https://example.com/a?!...", 0, "https://example.com/a"},
+		{"comma", "https://example.com/a, b", 0, "https://example.com/a"},
+		{"closing parenthesis of the sentence", "(see https://example.com/a)", 5, "https://example.com/a"},
+		{"parentheses of the url", "https://en.wikipedia.org/wiki/Go_(language)", 0, "https://en.wikipedia.org/wiki/Go_(language)"},
+		{"parentheses of the url in a sentence", "(https://en.wikipedia.org/wiki/Go_(language)).", 1, "https://en.wikipedia.org/wiki/Go_(language)"},
+		{"emphasis delimiters", "*https://example.com/a*", 1, "https://example.com/a"},
+		{"quote", "'https://example.com/a'", 1, "https://example.com/a"},
+		{"ends at a backtick", "https://example.com/a`b", 0, "https://example.com/a"},
+		{"after text", "xhttps://example.com", 1, ""},
+		{"only the scheme", "https://", 0, ""},
+		{"only the scheme and punctuation", "https://.", 0, ""},
+		{"not a web url", "ftp://example.com", 0, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := urlAt(tc.text, tc.i); got != tc.want {
+				t.Errorf("urlAt(%q, %d) = %q, want %q", tc.text, tc.i, got, tc.want)
+			}
+		})
+	}
+}
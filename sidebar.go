@@ -16,11 +16,16 @@ type Sidebar struct {
 	ctx context.Context
 
 	selectGroup func(nip29.GroupAddress)
+	removeGroup func(nip29.GroupAddress) bool
+	markDraft   func(nip29.GroupAddress, bool)
+
+	buttons map[string]*sidebutton.Sidebutton // by group address
 }
 
 func NewSidebar(ctx context.Context) *Sidebar {
 	s := &Sidebar{
-		ctx: ctx,
+		ctx:     ctx,
+		buttons: make(map[string]*sidebutton.Sidebutton),
 	}
 
 	discover := sidebutton.New(ctx, "Discover", func() {
@@ -28,6 +33,11 @@ func NewSidebar(ctx context.Context) *Sidebar {
 	})
 	discover.Icon.Avatar.SetIconName("earth-symbolic")
 
+	newGroup := sidebutton.New(ctx, "New Group", func() {
+		showCreateGroupDialog(ctx)
+	})
+	newGroup.Icon.Avatar.SetIconName("list-add-symbolic")
+
 	sep1 := gtk.NewSeparator(gtk.OrientationVertical)
 	sep1.AddCSSClass("spacer")
 
@@ -62,6 +72,7 @@ func NewSidebar(ctx context.Context) *Sidebar {
 	box.SetHExpand(true)
 	box.Append(sep1)
 	box.Append(discover)
+	box.Append(newGroup)
 	box.Append(sep2)
 	box.Append(groupsScroll)
 	box.Append(sep3)
@@ -73,6 +84,25 @@ func NewSidebar(ctx context.Context) *Sidebar {
 	s.ScrolledWindow.SetHExpand(true)
 	s.ScrolledWindow.SetHAlign(gtk.AlignFill)
 
+	// must be called on the main thread, tells if the group was in the sidebar
+	s.removeGroup = func(gad nip29.GroupAddress) bool {
+		delete(s.buttons, gad.String())
+		for lbr := range children[*gtk.ListBox, *gtk.ListBoxRow](groupsList) {
+			if lbr.Name() == gad.String() {
+				groupsList.Remove(lbr)
+				return true
+			}
+		}
+		return false
+	}
+
+	// groups with something written that wasn't sent get a marker
+	s.markDraft = func(gad nip29.GroupAddress, hasDraft bool) {
+		if button, ok := s.buttons[gad.String()]; ok {
+			button.Marker.SetVisible(hasDraft)
+		}
+	}
+
 	go func() {
 		me := global.GetMe(ctx)
 		for {
@@ -84,28 +114,39 @@ func NewSidebar(ctx context.Context) *Sidebar {
 						win.main.OpenGroup(gad)
 					})
 
+					button.Marker.SetFromIconName("document-edit-symbolic")
+					button.Marker.SetTooltipText("Unsent draft")
+
 					lbr := gtk.NewListBoxRow()
 					lbr.SetName(gad.String())
 					lbr.SetChild(button)
 
 					groupsList.Append(lbr)
+					s.buttons[gad.String()] = button
+					s.markDraft(gad, !global.GetDraft(gad).IsEmpty())
+
+					// the group may be deleted even if it was never opened
+					group.OnDeleted(func() {
+						glib.IdleAdd(func() { win.main.Groups.remove(group) })
+					})
 
 					group.OnUpdated(func() {
 						glib.IdleAdd(func() {
 							button.Label.SetText(group.Name)
 							button.Icon.SetFromURL(group.Picture)
+
+							if group.IsConnected() {
+								button.RemoveCSSClass("opacity-50")
+								button.SetTooltipText("")
+							} else {
+								button.AddCSSClass("opacity-50")
+								button.SetTooltipText("Disconnected")
+							}
 						})
 					})
 				})
 			case gad := <-me.LeftGroup:
-				glib.IdleAdd(func() {
-					for lbr := range children[*gtk.ListBox, *gtk.ListBoxRow](groupsList) {
-						if lbr.Name() == gad.String() {
-							groupsList.Remove(lbr)
-							break
-						}
-					}
-				})
+				glib.IdleAdd(func() { s.removeGroup(gad) })
 			}
 		}
 	}()
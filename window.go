@@ -32,6 +32,9 @@ type Window struct {
 	Stack        *gtk.Stack
 
 	main *MainView
+
+	loggedIn      bool
+	pendingInvite string // an invite link opened before we were logged in
 }
 
 func NewWindow(ctx context.Context) *Window {